@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inflightRequest is an API request that is being served
+type inflightRequest struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Owner  string `json:"owner,omitempty"`
+	// Sessions are the IDs of the Copilot sessions the request runs on
+	Sessions  []string  `json:"sessions,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	cancel    context.CancelFunc
+	live      []activeSession
+}
+
+// activeSession is a Copilot session serving a request
+type activeSession struct {
+	session copilotSession
+	model   string
+}
+
+type inflightRequestKey struct{}
+
+// requestTracker records the API requests in flight so the admin API can
+// list and cancel them. The zero value is ready to use.
+type requestTracker struct {
+	mu     sync.Mutex
+	next   int64
+	active map[string]*inflightRequest
+}
+
+// start registers a request and returns it with a context that is
+// cancelled when the request is cancelled through the admin API. The
+// caller must call done when the request has been served.
+func (t *requestTracker) start(r *http.Request) (*inflightRequest, context.Context) {
+	ctx, cancel := context.WithCancel(r.Context())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil {
+		t.active = make(map[string]*inflightRequest)
+	}
+	t.next++
+	req := &inflightRequest{
+		ID:        fmt.Sprintf("req_%d", t.next),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Owner:     tokenFingerprint(getAnthropicAPIKey(r)),
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	t.active[req.ID] = req
+	return req, context.WithValue(ctx, inflightRequestKey{}, req)
+}
+
+// identify sets the owner of the request ctx belongs to from the API key
+// it was authenticated with, which may have been sent in the body
+func (t *requestTracker) identify(ctx context.Context, apiKey string) {
+	req, ok := ctx.Value(inflightRequestKey{}).(*inflightRequest)
+	if !ok || apiKey == "" {
+		return
+	}
+	t.mu.Lock()
+	req.Owner = tokenFingerprint(apiKey)
+	t.mu.Unlock()
+}
+
+// attach records that the request ctx belongs to runs on session
+func (t *requestTracker) attach(ctx context.Context, session copilotSession, model string) {
+	req, ok := ctx.Value(inflightRequestKey{}).(*inflightRequest)
+	if !ok {
+		return
+	}
+	id := session.ID()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, existing := range req.Sessions {
+		if existing == id {
+			return
+		}
+	}
+	req.live = append(req.live, activeSession{session: session, model: model})
+	req.Sessions = append(req.Sessions, id)
+}
+
+// done removes a finished request
+func (t *requestTracker) done(req *inflightRequest) {
+	t.mu.Lock()
+	delete(t.active, req.ID)
+	t.mu.Unlock()
+	req.cancel()
+}
+
+// list returns the requests in flight, oldest first
+func (t *requestTracker) list() []inflightRequest {
+	t.mu.Lock()
+	requests := make([]inflightRequest, 0, len(t.active))
+	for _, req := range t.active {
+		copied := *req
+		copied.Sessions = append([]string(nil), req.Sessions...)
+		copied.live = append([]activeSession(nil), req.live...)
+		requests = append(requests, copied)
+	}
+	t.mu.Unlock()
+	sort.Slice(requests, func(i, j int) bool { return requests[i].StartedAt.Before(requests[j].StartedAt) })
+	return requests
+}
+
+// cancel cancels the request with the given ID, which aborts its Copilot
+// session. It reports false if there is no such request.
+func (t *requestTracker) cancel(id string) bool {
+	t.mu.Lock()
+	req, ok := t.active[id]
+	t.mu.Unlock()
+	if ok {
+		req.cancel()
+	}
+	return ok
+}
+
+// sessions describes the sessions of the requests in flight
+func (t *requestTracker) sessions() []sessionInfo {
+	infos := []sessionInfo{}
+	for _, req := range t.list() {
+		for _, live := range req.live {
+			infos = append(infos, sessionInfo{
+				ID:        live.session.ID(),
+				State:     "active",
+				RequestID: req.ID,
+				Owner:     req.Owner,
+				Model:     live.model,
+				LastUsed:  req.StartedAt,
+			})
+		}
+	}
+	return infos
+}
+
+// cancelSession cancels the request running on the session with the
+// given ID, and returns the request's ID
+func (t *requestTracker) cancelSession(id string) (string, bool) {
+	for _, req := range t.list() {
+		for _, live := range req.live {
+			if live.session.ID() == id {
+				return req.ID, t.cancel(req.ID)
+			}
+		}
+	}
+	return "", false
+}
+
+// TrackRequests registers the API requests served by next so they can be
+// listed and cancelled through the admin API.
+func (s *Server) TrackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") && !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req, ctx := s.requests.start(r)
+		defer s.requests.done(req)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientInfo describes a Copilot client for the admin API. Clients are
+// identified by the fingerprint of their GitHub token.
+type clientInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Default     bool   `json:"default"`
+}
+
+// listResponse is the envelope of admin API lists
+type listResponse struct {
+	Object string      `json:"object"`
+	Data   interface{} `json:"data"`
+}
+
+// createKeyRequest is the body of POST /admin/keys
+type createKeyRequest struct {
+	Name        string   `json:"name"`
+	GitHubToken string   `json:"github_token"`
+	Models      []string `json:"models"`
+	// TTL is a Go duration such as "720h"; empty keys never expire
+	TTL string `json:"ttl"`
+}
+
+// createKeyResponse returns a new key, the only time it is shown
+type createKeyResponse struct {
+	Key string `json:"key"`
+	adminKey
+}
+
+// adminKey is a virtual key as shown by the admin API, without its hash
+// or GitHub token
+type adminKey struct {
+	ID             string     `json:"id"`
+	Name           string     `json:"name,omitempty"`
+	Hint           string     `json:"hint"`
+	Models         []string   `json:"models,omitempty"`
+	HasGitHubToken bool       `json:"has_github_token"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newAdminKey(key *virtualKey) adminKey {
+	return adminKey{
+		ID:             key.ID,
+		Name:           key.Name,
+		Hint:           key.Hint,
+		Models:         key.Models,
+		HasGitHubToken: key.GitHubToken != "",
+		Status:         key.status(time.Now()),
+		CreatedAt:      key.CreatedAt,
+		ExpiresAt:      key.ExpiresAt,
+		RevokedAt:      key.RevokedAt,
+	}
+}
+
+// HandleAdmin serves the admin API under /admin/. Every request must
+// carry the admin token as a bearer token; without one configured the
+// API is disabled.
+func (s *Server) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	if s.config.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	presented := getAPIKeyFromHeader(r)
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(s.config.AdminToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, "Missing or invalid admin token", "authentication_error")
+		return
+	}
+
+	resource, id, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	switch {
+	case resource == "keys" && id == "" && r.Method == http.MethodGet:
+		s.adminListKeys(w)
+	case resource == "keys" && id == "" && r.Method == http.MethodPost:
+		s.adminCreateKey(w, r)
+	case resource == "keys" && id != "" && r.Method == http.MethodDelete:
+		s.adminRevokeKey(w, id)
+	case resource == "clients" && id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, listResponse{Object: "list", Data: s.listClients()})
+	case resource == "clients" && id != "" && r.Method == http.MethodDelete:
+		s.adminStopClient(w, id)
+	case resource == "requests" && id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, listResponse{Object: "list", Data: s.requests.list()})
+	case resource == "requests" && id != "" && r.Method == http.MethodDelete:
+		if !s.requests.cancel(id) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Request '%s' not found", id), "invalid_request_error")
+			return
+		}
+		slog.InfoContext(r.Context(), "Admin cancelled request", "id", id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "cancelled": true})
+	case resource == "sessions" && id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, listResponse{Object: "list", Data: s.listSessions()})
+	case resource == "sessions" && id != "" && r.Method == http.MethodDelete:
+		s.adminDeleteSession(w, r, id)
+	case resource == "keys" || resource == "clients" || resource == "requests" || resource == "sessions":
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error")
+	default:
+		writeError(w, http.StatusNotFound, "Not found", "invalid_request_error")
+	}
+}
+
+func (s *Server) adminListKeys(w http.ResponseWriter) {
+	if s.keys == nil {
+		writeError(w, http.StatusBadRequest, "Virtual API keys are not enabled; start the server with -keys-file", "invalid_request_error")
+		return
+	}
+	keys, err := s.keys.list()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error(), "api_error")
+		return
+	}
+	data := make([]adminKey, 0, len(keys))
+	for i := range keys {
+		data = append(data, newAdminKey(&keys[i]))
+	}
+	writeJSON(w, http.StatusOK, listResponse{Object: "list", Data: data})
+}
+
+func (s *Server) adminCreateKey(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		writeError(w, http.StatusBadRequest, "Virtual API keys are not enabled; start the server with -keys-file", "invalid_request_error")
+		return
+	}
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body", "invalid_request_error")
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ttl %q", req.TTL), "invalid_request_error")
+			return
+		}
+	}
+	plain, key, err := s.keys.create(req.Name, req.GitHubToken, req.Models, ttl)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error(), "api_error")
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin created key", "key_id", key.ID)
+	writeJSON(w, http.StatusCreated, createKeyResponse{Key: plain, adminKey: newAdminKey(key)})
+}
+
+func (s *Server) adminRevokeKey(w http.ResponseWriter, id string) {
+	if s.keys == nil {
+		writeError(w, http.StatusBadRequest, "Virtual API keys are not enabled; start the server with -keys-file", "invalid_request_error")
+		return
+	}
+	found, err := s.keys.revoke(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error(), "api_error")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Key '%s' not found", id), "invalid_request_error")
+		return
+	}
+	slog.Info("Admin revoked key", "key_id", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "revoked": true})
+}
+
+// listSessions describes the sessions serving requests in flight and the
+// idle ones kept for reuse. A session being returned to the cache as its
+// request finishes is listed once, as idle.
+func (s *Server) listSessions() []sessionInfo {
+	sessions := s.sessions.list()
+	idle := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		idle[session.ID] = true
+	}
+	for _, session := range s.requests.sessions() {
+		if !idle[session.ID] {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// adminDeleteSession destroys an idle session, or cancels the request an
+// active session is serving, which aborts and destroys it
+func (s *Server) adminDeleteSession(w http.ResponseWriter, r *http.Request, id string) {
+	if s.sessions.remove(func(l *liveSession) bool { return l.session.ID() == id }) > 0 {
+		slog.InfoContext(r.Context(), "Admin destroyed session", "session_id", id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "deleted": true})
+		return
+	}
+	requestID, ok := s.requests.cancelSession(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Session '%s' not found", id), "invalid_request_error")
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin cancelled request to destroy its session", "session_id", id, "id", requestID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "deleted": true, "request_id": requestID})
+}
+
+// listClients describes the running Copilot clients
+func (s *Server) listClients() []clientInfo {
+	clients := []clientInfo{}
+	s.mu.Lock()
+	if s.defaultClient != nil {
+		clients = append(clients, clientInfo{Fingerprint: tokenFingerprint(s.defaultToken), Default: true})
+	}
+	s.mu.Unlock()
+	for _, fingerprint := range s.clients.fingerprints() {
+		clients = append(clients, clientInfo{Fingerprint: fingerprint})
+	}
+	return clients
+}
+
+func (s *Server) adminStopClient(w http.ResponseWriter, fingerprint string) {
+	if s.defaultClient != nil && fingerprint == tokenFingerprint(s.defaultToken) {
+		writeError(w, http.StatusBadRequest, "The default client cannot be stopped", "invalid_request_error")
+		return
+	}
+	if !s.clients.remove(fingerprint) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Client '%s' not found", fingerprint), "invalid_request_error")
+		return
+	}
+	slog.Info("Admin force-stopped client", "fingerprint", fingerprint)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"fingerprint": fingerprint, "stopped": true})
+}
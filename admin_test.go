@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func adminRequest(srv *Server, method, path, token, body string) *responseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleAdmin(rw, req)
+	return rw
+}
+
+func TestHandleAdmin_Auth(t *testing.T) {
+	srv := &Server{clients: &clientPool{}}
+	if rw := adminRequest(srv, "GET", "/admin/clients", "anything", ""); rw.status != http.StatusNotFound {
+		t.Errorf("expected the admin API to be disabled without a token, got %d", rw.status)
+	}
+
+	srv.config.AdminToken = "s3cret"
+	if rw := adminRequest(srv, "GET", "/admin/clients", "wrong", ""); rw.status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong token, got %d", rw.status)
+	}
+	if rw := adminRequest(srv, "GET", "/admin/clients", "s3cret", ""); rw.status != 0 && rw.status != http.StatusOK {
+		t.Errorf("expected 200, got %d", rw.status)
+	}
+}
+
+func TestHandleAdmin_Keys(t *testing.T) {
+	store, err := openKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{clients: &clientPool{}, keys: store, config: Config{AdminToken: "s3cret"}}
+
+	rw := adminRequest(srv, "POST", "/admin/keys", "s3cret", `{"name":"ci","github_token":"ghp_x","models":["gpt-4o"],"ttl":"24h"}`)
+	if rw.status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rw.status, rw.body.String())
+	}
+	var created createKeyResponse
+	json.Unmarshal([]byte(rw.body.String()), &created)
+	if !strings.HasPrefix(created.Key, "sk-") || created.ExpiresAt == nil || !created.HasGitHubToken {
+		t.Errorf("unexpected key %+v", created)
+	}
+
+	rw = adminRequest(srv, "GET", "/admin/keys", "s3cret", "")
+	if strings.Contains(rw.body.String(), "ghp_x") || strings.Contains(rw.body.String(), created.Key) {
+		t.Error("expected listed keys to hide the key and its GitHub token")
+	}
+
+	if rw := adminRequest(srv, "DELETE", "/admin/keys/"+created.ID, "s3cret", ""); rw.status != 0 && rw.status != http.StatusOK {
+		t.Errorf("expected revoke to succeed, got %d", rw.status)
+	}
+	if _, err := store.lookup(created.Key); err == nil {
+		t.Error("expected the revoked key to be rejected")
+	}
+	if rw := adminRequest(srv, "DELETE", "/admin/keys/key_missing", "s3cret", ""); rw.status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", rw.status)
+	}
+}
+
+func TestHandleAdmin_Clients(t *testing.T) {
+	srv := &Server{
+		clients: &clientPool{entries: map[string]*pooledClient{hashToken("ghp_user"): {client: &copilot.Client{}, token: "ghp_user"}}},
+		config:  Config{AdminToken: "s3cret"},
+	}
+
+	clients := srv.listClients()
+	if len(clients) != 1 || clients[0].Fingerprint != tokenFingerprint("ghp_user") {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+	if strings.Contains(adminRequest(srv, "GET", "/admin/clients", "s3cret", "").body.String(), "ghp_user") {
+		t.Error("expected tokens not to be exposed")
+	}
+
+	if rw := adminRequest(srv, "DELETE", "/admin/clients/"+clients[0].Fingerprint, "s3cret", ""); rw.status != 0 && rw.status != http.StatusOK {
+		t.Fatalf("expected the client to be stopped, got %d", rw.status)
+	}
+	if srv.clients.Len() != 0 {
+		t.Error("expected the stopped client to be removed")
+	}
+	if rw := adminRequest(srv, "DELETE", "/admin/clients/unknown", "s3cret", ""); rw.status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown client, got %d", rw.status)
+	}
+}
+
+func TestRequestTracker(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, config: Config{AdminToken: "s3cret"}}
+	started := make(chan string)
+	release := make(chan struct{})
+	handler := srv.TrackRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests := srv.requests.list()
+		started <- requests[0].ID
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", nil)
+		handler.ServeHTTP(&responseRecorder{head: http.Header{}}, req)
+		close(done)
+	}()
+
+	id := <-started
+	if rw := adminRequest(srv, "DELETE", "/admin/requests/"+id, "s3cret", ""); rw.status != 0 && rw.status != http.StatusOK {
+		close(release)
+		t.Fatalf("expected the request to be cancelled, got %d", rw.status)
+	}
+	<-done
+	if len(srv.requests.list()) != 0 {
+		t.Error("expected the finished request to be removed")
+	}
+}
+
+func TestHandleAdmin_ActiveSessions(t *testing.T) {
+	// The turn never goes idle, so the request stays in flight
+	backend := newFakeBackend([]copilot.SessionEvent{deltaEvent("Thinking")})
+	srv, ts := newFakeServer(t, backend)
+	srv.config.AdminToken = "s3cret"
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Post(ts.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o","api_key":"ghp_body","messages":[{"role":"user","content":"Hi"}]}`))
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+
+	var sessions []sessionInfo
+	for deadline := time.Now().Add(5 * time.Second); len(sessions) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the active session was never listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+		var list struct{ Data []sessionInfo }
+		json.Unmarshal([]byte(adminRequest(srv, "GET", "/admin/sessions", "s3cret", "").body.String()), &list)
+		sessions = list.Data
+	}
+	session := sessions[0]
+	if session.State != "active" || session.RequestID == "" || session.Model != "gpt-4o" {
+		t.Errorf("session = %+v, want the active session of the request", session)
+	}
+	if session.Owner != tokenFingerprint("ghp_body") {
+		t.Errorf("owner = %q, want the fingerprint of the key sent in the body", session.Owner)
+	}
+
+	if rw := adminRequest(srv, "DELETE", "/admin/sessions/"+session.ID, "s3cret", ""); rw.status != 0 && rw.status != http.StatusOK {
+		t.Fatalf("expected the active session to be deleted, got %d", rw.status)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not cancelled")
+	}
+	if backend.aborted != 1 {
+		t.Errorf("aborted %d sessions, want 1", backend.aborted)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UnmarshalJSON accepts content either as a plain string, treated as a
+// single text block, or as an array of content blocks.
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, `"`) {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// text joins the text blocks of the content.
+func (c AnthropicContent) text() string {
+	var texts []string
+	for _, block := range c {
+		if block.Type == "text" && block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// getAnthropicAPIKey returns the token supplied via the x-api-key header
+// used by Anthropic clients, falling back to Authorization: Bearer.
+func getAnthropicAPIKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("x-api-key")); key != "" {
+		return key
+	}
+	return getAPIKeyFromHeader(r)
+}
+
+// anthropicMessagesToMessages converts an Anthropic system prompt and
+// messages into chat messages. tool_result blocks become tool messages
+// and tool_use blocks become assistant tool calls, so the conversation
+// flattens through buildPrompt like a chat completions request.
+func anthropicMessagesToMessages(system AnthropicContent, messages []AnthropicMessage) ([]Message, error) {
+	var converted []Message
+	if text := system.text(); text != "" {
+		converted = append(converted, Message{Role: "system", Content: text})
+	}
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user":
+			var parts []ContentPart
+			for _, block := range msg.Content {
+				switch block.Type {
+				case "text":
+					parts = append(parts, ContentPart{Type: "text", Text: block.Text})
+				case "image":
+					part, err := anthropicImagePart(block.Source)
+					if err != nil {
+						return nil, err
+					}
+					parts = append(parts, part)
+				case "tool_result":
+					content := block.Content.text()
+					if block.IsError {
+						content = "Error: " + content
+					}
+					converted = append(converted, Message{
+						Role:       "tool",
+						ToolCallID: block.ToolUseID,
+						Content:    content,
+					})
+				default:
+					return nil, fmt.Errorf("unsupported content block type %q", block.Type)
+				}
+			}
+			if len(parts) > 0 {
+				converted = append(converted, Message{
+					Role:    "user",
+					Content: flattenContentParts(parts),
+					Parts:   parts,
+				})
+			}
+
+		case "assistant":
+			out := Message{Role: "assistant"}
+			for _, block := range msg.Content {
+				switch block.Type {
+				case "text":
+					out.Content += block.Text
+				case "tool_use":
+					args := string(block.Input)
+					if args == "" {
+						args = "{}"
+					}
+					out.ToolCalls = append(out.ToolCalls, ToolCall{
+						ID:   block.ID,
+						Type: "function",
+						Function: ToolCallFunction{
+							Name:      block.Name,
+							Arguments: args,
+						},
+					})
+				case "thinking", "redacted_thinking":
+					// Reasoning from previous turns carries no prompt content
+					continue
+				default:
+					return nil, fmt.Errorf("unsupported content block type %q", block.Type)
+				}
+			}
+			converted = append(converted, out)
+
+		default:
+			return nil, fmt.Errorf("unsupported message role %q", msg.Role)
+		}
+	}
+	return converted, nil
+}
+
+// anthropicImagePart converts an image block source into an image_url
+// content part so it is attached like an OpenAI image.
+func anthropicImagePart(source *AnthropicImageSource) (ContentPart, error) {
+	if source == nil {
+		return ContentPart{}, fmt.Errorf("image block is missing a source")
+	}
+	var url string
+	switch source.Type {
+	case "base64":
+		url = fmt.Sprintf("data:%s;base64,%s", source.MediaType, source.Data)
+	case "url":
+		url = source.URL
+	default:
+		return ContentPart{}, fmt.Errorf("unsupported image source type %q", source.Type)
+	}
+	return ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}}, nil
+}
+
+// anthropicToolsToChatTools converts Anthropic tool definitions into the
+// chat completions form, narrowed to the tools tool_choice allows.
+func anthropicToolsToChatTools(tools []AnthropicTool, choice *AnthropicToolChoice) ([]Tool, error) {
+	converted := make([]Tool, 0, len(tools))
+	for _, tool := range tools {
+		converted = append(converted, Tool{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	return anthropicToolChoice(choice).apply(converted)
+}
+
+// toolInputJSON returns tool call arguments as a JSON object, since
+// Anthropic requires tool_use input to be an object.
+func toolInputJSON(arguments string) json.RawMessage {
+	if trimmed := strings.TrimSpace(arguments); trimmed == "" || trimmed == "null" {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// anthropicStopReason maps a turn result onto Anthropic's stop_reason
+// and stop_sequence.
+func anthropicStopReason(result *turnResult) (*string, *string) {
+	switch {
+	case result.StopSequence != "":
+		return strPtr("stop_sequence"), strPtr(result.StopSequence)
+	case result.FinishReason == "tool_calls":
+		return strPtr("tool_use"), nil
+	case result.FinishReason == "length":
+		return strPtr("max_tokens"), nil
+	default:
+		return strPtr("end_turn"), nil
+	}
+}
+
+// anthropicUsage converts usage into Anthropic's form
+func anthropicUsage(usage *Usage) AnthropicUsage {
+	return AnthropicUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens}
+}
+
+// anthropicErrorType maps an HTTP status onto an Anthropic error type.
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
+	default:
+		if status >= 400 && status < 500 {
+			return "invalid_request_error"
+		}
+		return "api_error"
+	}
+}
+
+// writeAnthropicError writes an Anthropic-style error response
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, AnthropicErrorResponse{
+		Type: "error",
+		Error: AnthropicErrorDetail{
+			Type:    anthropicErrorType(status),
+			Message: message,
+		},
+	})
+}
+
+// HandleMessages handles POST /v1/messages
+func (s *Server) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req AnthropicRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	client, err := s.clientFor(r.Context(), getAnthropicAPIKey(r), req.Model)
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		writeAnthropicError(w, status, msg)
+		return
+	}
+	labelRequest(r.Context(), req.Model, req.Stream)
+
+	if req.Model == "" {
+		writeAnthropicError(w, http.StatusBadRequest, "model: Field required")
+		return
+	}
+	if req.MaxTokens < 1 {
+		writeAnthropicError(w, http.StatusBadRequest, "max_tokens: must be at least 1")
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeAnthropicError(w, http.StatusBadRequest, "messages: Field required")
+		return
+	}
+
+	messages, err := anthropicMessagesToMessages(req.System, req.Messages)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tools, err := anthropicToolsToChatTools(req.Tools, req.ToolChoice)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conv, err := s.openConversation(r.Context(), client, conversationRequest{
+		Owner:      tokenFingerprint(getAnthropicAPIKey(r)),
+		SessionID:  sessionIDFromHeader(w, r),
+		Model:      req.Model,
+		Messages:   messages,
+		Tools:      tools,
+		ToolChoice: anthropicToolChoice(req.ToolChoice),
+		Stream:     req.Stream,
+	})
+	if err != nil {
+		status, msg := conversationErrorStatus(err)
+		writeAnthropicError(w, status, msg)
+		return
+	}
+	defer conv.close()
+
+	opts := turnOptions{Stop: req.StopSequences, MaxTokens: req.MaxTokens, Messages: messages}
+	var result *turnResult
+	if req.Stream {
+		result = s.handleStreamingMessages(r.Context(), w, conv, req.Model, opts)
+	} else {
+		result = s.handleNonStreamingMessages(r.Context(), w, conv, req.Model, opts)
+	}
+	conv.keep(result)
+}
+
+// handleNonStreamingMessages runs an Anthropic request to completion and
+// returns the turn result, or nil if the turn failed
+func (s *Server) handleNonStreamingMessages(ctx context.Context, w http.ResponseWriter, conv *conversation, model string, opts turnOptions) *turnResult {
+	result, err := conv.run(ctx, opts)
+	if err != nil {
+		status, msg := turnErrorStatus(err)
+		writeAnthropicError(w, status, msg)
+		return nil
+	}
+
+	content := []AnthropicResponseBlock{}
+	if result.Content != "" {
+		content = append(content, AnthropicResponseBlock{Type: "text", Text: strPtr(result.Content)})
+	}
+	for _, call := range result.ToolCalls {
+		content = append(content, AnthropicResponseBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: toolInputJSON(call.Function.Arguments),
+		})
+	}
+
+	stopReason, stopSequence := anthropicStopReason(result)
+	writeJSON(w, http.StatusOK, AnthropicResponse{
+		ID:           fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        model,
+		Content:      content,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        anthropicUsage(result.Usage),
+	})
+	return result
+}
+
+// handleStreamingMessages streams an Anthropic request as the
+// message_start / content_block_* / message_delta / message_stop event
+// sequence. Nothing is written until the first output arrives so early
+// failures are still reported with a proper HTTP status. It returns the
+// turn result, or nil if the turn failed.
+func (s *Server) handleStreamingMessages(ctx context.Context, w http.ResponseWriter, conv *conversation, model string, opts turnOptions) *turnResult {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, http.StatusInternalServerError, "Streaming not supported")
+		return nil
+	}
+
+	messageID := fmt.Sprintf("msg_%d", time.Now().UnixNano())
+	started := false
+	blockIndex := 0
+	textOpen := false
+
+	emit := func(event AnthropicStreamEvent) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+	}
+
+	ensureStarted := func() {
+		if started {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		started = true
+		// The input tokens are estimated here; message_delta carries the
+		// final counts
+		emit(AnthropicStreamEvent{Type: "message_start", Message: &AnthropicResponse{
+			ID:      messageID,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   model,
+			Content: []AnthropicResponseBlock{},
+			Usage:   anthropicUsage(estimateUsage(opts.Messages, &turnResult{})),
+		}})
+		emit(AnthropicStreamEvent{Type: "ping"})
+	}
+
+	closeText := func() {
+		if !textOpen {
+			return
+		}
+		textOpen = false
+		emit(AnthropicStreamEvent{Type: "content_block_stop", Index: intPtr(blockIndex)})
+		blockIndex++
+	}
+
+	sendText := func(delta string) {
+		ensureStarted()
+		if !textOpen {
+			textOpen = true
+			emit(AnthropicStreamEvent{
+				Type:         "content_block_start",
+				Index:        intPtr(blockIndex),
+				ContentBlock: &AnthropicResponseBlock{Type: "text", Text: strPtr("")},
+			})
+		}
+		emit(AnthropicStreamEvent{
+			Type:  "content_block_delta",
+			Index: intPtr(blockIndex),
+			Delta: AnthropicContentDelta{Type: "text_delta", Text: &delta},
+		})
+	}
+
+	streamedText := false
+	opts.OnDelta = func(delta string) {
+		streamedText = true
+		sendText(delta)
+	}
+	opts.OnToolCall = func(index int, call ToolCall) {
+		closeText()
+		ensureStarted()
+		emit(AnthropicStreamEvent{
+			Type:  "content_block_start",
+			Index: intPtr(blockIndex),
+			ContentBlock: &AnthropicResponseBlock{
+				Type:  "tool_use",
+				ID:    call.ID,
+				Name:  call.Function.Name,
+				Input: json.RawMessage("{}"),
+			},
+		})
+		args := string(toolInputJSON(call.Function.Arguments))
+		emit(AnthropicStreamEvent{
+			Type:  "content_block_delta",
+			Index: intPtr(blockIndex),
+			Delta: AnthropicContentDelta{Type: "input_json_delta", PartialJSON: &args},
+		})
+		emit(AnthropicStreamEvent{Type: "content_block_stop", Index: intPtr(blockIndex)})
+		blockIndex++
+	}
+
+	result, err := conv.run(ctx, opts)
+	if err != nil {
+		status, msg := turnErrorStatus(err)
+		if !started {
+			writeAnthropicError(w, status, msg)
+			return nil
+		}
+		emit(AnthropicStreamEvent{Type: "error", Error: &AnthropicErrorDetail{
+			Type:    anthropicErrorType(status),
+			Message: msg,
+		}})
+		return nil
+	}
+
+	// Models that do not stream deltas still deliver the final content
+	if !streamedText && result.Content != "" {
+		sendText(result.Content)
+	}
+	closeText()
+
+	ensureStarted()
+	stopReason, stopSequence := anthropicStopReason(result)
+	usage := anthropicUsage(result.Usage)
+	emit(AnthropicStreamEvent{
+		Type:  "message_delta",
+		Delta: AnthropicMessageDelta{StopReason: stopReason, StopSequence: stopSequence},
+		Usage: &usage,
+	})
+	emit(AnthropicStreamEvent{Type: "message_stop"})
+	return result
+}
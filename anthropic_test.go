@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestAnthropicMessagesToMessages(t *testing.T) {
+	body := `{
+		"model": "claude-sonnet-4",
+		"max_tokens": 1024,
+		"system": [{"type":"text","text":"Be terse."}],
+		"messages": [
+			{"role":"user","content":"Weather in Paris?"},
+			{"role":"assistant","content":[
+				{"type":"thinking","thinking":"..."},
+				{"type":"text","text":"Checking."},
+				{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}
+			]},
+			{"role":"user","content":[
+				{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"sunny"}]},
+				{"type":"text","text":"And tomorrow?"},
+				{"type":"image","source":{"type":"base64","media_type":"image/png","data":"aGk="}}
+			]}
+		]
+	}`
+	var req AnthropicRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	messages, err := anthropicMessagesToMessages(req.System, req.Messages)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 5 {
+		t.Fatalf("expected 5 messages, got %d: %+v", len(messages), messages)
+	}
+	if messages[0].Role != "system" || messages[0].Content != "Be terse." {
+		t.Errorf("unexpected system message: %+v", messages[0])
+	}
+	if messages[2].Content != "Checking." || len(messages[2].ToolCalls) != 1 || messages[2].ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected assistant message: %+v", messages[2])
+	}
+	if messages[3].Role != "tool" || messages[3].ToolCallID != "toolu_1" || messages[3].Content != "sunny" {
+		t.Errorf("unexpected tool message: %+v", messages[3])
+	}
+	if messages[4].Content != "And tomorrow?" || len(messages[4].Parts) != 2 {
+		t.Errorf("unexpected user message: %+v", messages[4])
+	}
+	if url := messages[4].Parts[1].ImageURL.URL; url != "data:image/png;base64,aGk=" {
+		t.Errorf("unexpected image URL: %q", url)
+	}
+
+	prompt := buildPrompt(messages)
+	if strings.Contains(prompt, "Be terse.") {
+		t.Errorf("system prompt should not be part of the prompt:\n%s", prompt)
+	}
+}
+
+func TestAnthropicToolsToChatTools(t *testing.T) {
+	tools := []AnthropicTool{
+		{Name: "get_weather", InputSchema: map[string]interface{}{"type": "object"}},
+		{Name: "get_time", InputSchema: map[string]interface{}{"type": "object"}},
+	}
+
+	all, err := anthropicToolsToChatTools(tools, &AnthropicToolChoice{Type: "auto"})
+	if err != nil || len(all) != 2 || all[0].Function.Parameters["type"] != "object" {
+		t.Fatalf("auto: unexpected tools %+v, err %v", all, err)
+	}
+
+	none, err := anthropicToolsToChatTools(tools, &AnthropicToolChoice{Type: "none"})
+	if err != nil || len(none) != 0 {
+		t.Fatalf("none: expected no tools, got %+v, err %v", none, err)
+	}
+
+	one, err := anthropicToolsToChatTools(tools, &AnthropicToolChoice{Type: "tool", Name: "get_time"})
+	if err != nil || len(one) != 1 || one[0].Function.Name != "get_time" {
+		t.Fatalf("tool: unexpected tools %+v, err %v", one, err)
+	}
+
+	if _, err := anthropicToolsToChatTools(tools, &AnthropicToolChoice{Type: "tool", Name: "missing"}); err == nil {
+		t.Fatal("expected error for unknown tool")
+	}
+}
+
+func TestAnthropicStopReason(t *testing.T) {
+	tests := []struct {
+		result   turnResult
+		want     string
+		wantStop string
+	}{
+		{turnResult{FinishReason: "stop"}, "end_turn", ""},
+		{turnResult{FinishReason: "stop", StopSequence: "###"}, "stop_sequence", "###"},
+		{turnResult{FinishReason: "tool_calls"}, "tool_use", ""},
+		{turnResult{FinishReason: "length"}, "max_tokens", ""},
+	}
+	for _, tt := range tests {
+		reason, stop := anthropicStopReason(&tt.result)
+		if *reason != tt.want {
+			t.Errorf("stop_reason = %q, want %q", *reason, tt.want)
+		}
+		if (stop == nil && tt.wantStop != "") || (stop != nil && *stop != tt.wantStop) {
+			t.Errorf("stop_sequence = %v, want %q", stop, tt.wantStop)
+		}
+	}
+}
+
+func TestHandleMessages_NoAPIKey(t *testing.T) {
+	srv := &Server{clients: &clientPool{}}
+	reqBody := `{"model":"claude-sonnet-4","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", strings.NewReader(reqBody))
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleMessages(rw, req)
+	if rw.status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rw.status)
+	}
+
+	var resp AnthropicErrorResponse
+	if err := json.Unmarshal([]byte(rw.body.String()), &resp); err != nil {
+		t.Fatalf("invalid error body: %v", err)
+	}
+	if resp.Type != "error" || resp.Error.Type != "authentication_error" {
+		t.Fatalf("unexpected error body: %+v", resp)
+	}
+}
+
+func TestHandleMessages_MaxTokensAndUsage(t *testing.T) {
+	backend := newFakeBackend(
+		[]copilot.SessionEvent{messageEvent("one two three four five six"), idleEvent()},
+		[]copilot.SessionEvent{deltaEvent("Hi "), deltaEvent("there"), messageEvent("Hi there"), usageEvent(20, 2), idleEvent()},
+	)
+	_, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/v1/messages", `{"model":"claude-sonnet-4","max_tokens":2,"messages":[{"role":"user","content":"Count"}]}`)
+	var msg AnthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.StopReason == nil || *msg.StopReason != "max_tokens" || *msg.Content[0].Text != "one two" {
+		t.Errorf("message = %+v, want it cut off with stop_reason max_tokens", msg)
+	}
+	if msg.Usage.InputTokens == 0 || msg.Usage.OutputTokens != 2 {
+		t.Errorf("usage = %+v", msg.Usage)
+	}
+
+	resp = postJSON(t, ts.URL+"/v1/messages", `{"model":"claude-sonnet-4","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"usage":{"input_tokens":20,"output_tokens":2}`) {
+		t.Errorf("message_delta lacks the reported usage: %s", body)
+	}
+}
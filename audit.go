@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEndpoints are the endpoints that run completions and are audited
+var auditEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/responses":        true,
+	"/v1/messages":         true,
+	"/api/chat":            true,
+	"/api/generate":        true,
+}
+
+// auditRecord is one line of the audit log, describing one request.
+// Prompt and Response are only filled in when full capture is enabled.
+type auditRecord struct {
+	Time          time.Time     `json:"time"`
+	RequestID     string        `json:"request_id,omitempty"`
+	Endpoint      string        `json:"endpoint"`
+	KeyID         string        `json:"key_id,omitempty"`
+	Model         string        `json:"model,omitempty"`
+	Stream        bool          `json:"stream"`
+	Messages      int           `json:"messages"`
+	Tools         []string      `json:"tools,omitempty"`
+	FinishReasons []string      `json:"finish_reasons,omitempty"`
+	Usage         *Usage        `json:"usage,omitempty"`
+	LatencyMS     int64         `json:"latency_ms"`
+	Status        int           `json:"status"`
+	Error         string        `json:"error,omitempty"`
+	Prompt        []Message     `json:"prompt,omitempty"`
+	Response      []auditOutput `json:"response,omitempty"`
+}
+
+// auditOutput is the output of one choice, for full capture
+type auditOutput struct {
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// auditLog appends audit records to a JSONL file, rotating it once it
+// grows past maxSize bytes or has been written to for longer than
+// maxAge. Rotated files keep the name with the rotation time added, e.g.
+// audit-20260102T150405.jsonl. Zero disables either limit.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	capture bool
+	// keySecret keys the HMAC that identifies API keys other than
+	// virtual keys; without it they are not recorded
+	keySecret []byte
+	file      *os.File
+	size      int64
+	opened    time.Time
+	now       func() time.Time
+}
+
+// openAuditLog opens, or creates, the audit log at path
+func openAuditLog(path string, maxSize int64, maxAge time.Duration, capture bool, keySecret string) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxAge: maxAge, capture: capture, keySecret: []byte(keySecret), now: time.Now}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the current file for appending. The file can hold prompts,
+// so only the owner may read it.
+func (a *auditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.file, a.size, a.opened = f, info.Size(), a.now()
+	return nil
+}
+
+// rotate closes the current file, renames it after the current time and
+// starts a new one
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(a.path)
+	base := strings.TrimSuffix(a.path, ext)
+	stamp := a.now().UTC().Format("20060102T150405")
+	rotated := fmt.Sprintf("%s-%s%s", base, stamp, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%s.%d%s", base, stamp, i, ext)
+	}
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// write appends a record, rotating first if the file is full or old
+func (a *auditLog) write(rec *auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	full := a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize
+	old := a.maxAge > 0 && a.now().Sub(a.opened) >= a.maxAge
+	if full || old {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the audit log
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// auditEntry collects the record of a request while it is served
+type auditEntry struct {
+	mu        sync.Mutex
+	rec       auditRecord
+	capture   bool
+	keySecret []byte
+}
+
+type auditEntryKey struct{}
+
+// auditKeyID identifies an API key that is not a virtual key by a
+// truncated HMAC-SHA256 keyed with secret. Unlike tokenFingerprint it is
+// the same across restarts, so records of one caller can be joined, but
+// a guessed token cannot be checked against it without the secret.
+// Without a secret the key is not recorded.
+func auditKeyID(secret []byte, apiKey string) string {
+	if len(secret) == 0 || apiKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(apiKey))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// auditKey records the key the request authenticated with: the ID of
+// the virtual key it resolved to, or otherwise its auditKeyID
+func auditKey(ctx context.Context, apiKey, virtualKeyID string) {
+	entry, _ := ctx.Value(auditEntryKey{}).(*auditEntry)
+	if entry == nil {
+		return
+	}
+	id := virtualKeyID
+	if id == "" {
+		id = auditKeyID(entry.keySecret, apiKey)
+	}
+	entry.mu.Lock()
+	entry.rec.KeyID = id
+	entry.mu.Unlock()
+}
+
+// auditTurn adds the outcome of a turn to the request's audit record.
+// Requests with several choices run one turn per choice.
+func auditTurn(ctx context.Context, req conversationRequest, result *turnResult, err error) {
+	entry, _ := ctx.Value(auditEntryKey{}).(*auditEntry)
+	if entry == nil {
+		return
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	rec := &entry.rec
+	rec.Model = req.Model
+	rec.Messages = len(req.Messages)
+	rec.Tools = rec.Tools[:0]
+	for _, tool := range req.Tools {
+		rec.Tools = append(rec.Tools, tool.Function.Name)
+	}
+	if entry.capture {
+		rec.Prompt = req.Messages
+	}
+	if err != nil {
+		_, rec.Error = turnErrorStatus(err)
+		return
+	}
+	rec.FinishReasons = append(rec.FinishReasons, result.FinishReason)
+	rec.Usage = addUsage(rec.Usage, result.Usage)
+	if entry.capture {
+		rec.Response = append(rec.Response, auditOutput{Content: result.Content, ToolCalls: result.ToolCalls})
+	}
+}
+
+// AuditRequests writes an audit record for every completion request
+// served by next. It does nothing unless an audit log is configured.
+func (s *Server) AuditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.audit == nil || r.Method != http.MethodPost || !auditEndpoints[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		entry := &auditEntry{capture: s.audit.capture, keySecret: s.audit.keySecret, rec: auditRecord{
+			Time:      start.UTC(),
+			RequestID: requestIDFromContext(r.Context()),
+			Endpoint:  r.URL.Path,
+			KeyID:     auditKeyID(s.audit.keySecret, getAnthropicAPIKey(r)),
+		}}
+		wrapped := newResponseWriter(w, false)
+		next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry)))
+
+		entry.mu.Lock()
+		rec := entry.rec
+		entry.mu.Unlock()
+		if m := metricsFromContext(r.Context()); m != nil {
+			m.mu.Lock()
+			rec.Stream = m.stream
+			if rec.Model == "" {
+				rec.Model = m.model
+			}
+			m.mu.Unlock()
+		}
+		rec.LatencyMS = time.Since(start).Milliseconds()
+		rec.Status = wrapped.statusCode
+		if err := s.audit.write(&rec); err != nil {
+			slog.ErrorContext(r.Context(), "Writing audit record failed", "error", err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := openAuditLog(path, 200, time.Hour, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	audit.now = func() time.Time { return now }
+	audit.opened = now
+
+	// Each record is about 100 bytes, so the third one rotates the file
+	for i := 0; i < 3; i++ {
+		if err := audit.write(&auditRecord{Endpoint: "/v1/chat/completions", Model: "gpt-4o"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit-20260102T150405.jsonl")); err != nil {
+		t.Fatalf("expected the full file to be rotated: %v", err)
+	}
+	if got := len(readAuditRecords(t, path)); got != 1 {
+		t.Errorf("expected one record in the new file, got %d", got)
+	}
+
+	// An old file is rotated regardless of its size
+	now = now.Add(2 * time.Hour)
+	if err := audit.write(&auditRecord{Endpoint: "/v1/messages"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit-20260102T170405.jsonl")); err != nil {
+		t.Fatalf("expected the old file to be rotated: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the audit log to be private, got %v", info.Mode().Perm())
+	}
+}
+
+func TestAuditRequests(t *testing.T) {
+	for _, capture := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		audit, err := openAuditLog(path, 0, 0, capture, "s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{clients: &clientPool{}, audit: audit}
+		handler := srv.AuditRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auditKey(r.Context(), "ghp_secret", "")
+			req := conversationRequest{
+				Model:    "gpt-4o",
+				Messages: []Message{{Role: "user", Content: "What is the weather?"}},
+				Tools:    []Tool{{Type: "function", Function: ToolFunction{Name: "get_weather"}}},
+			}
+			auditTurn(r.Context(), req, &turnResult{Content: "Sunny", FinishReason: "stop", Usage: &Usage{PromptTokens: 5, CompletionTokens: 1}}, nil)
+			auditTurn(r.Context(), req, nil, errTurnTimeout)
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}))
+		req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), requestIDKey{}, "req_1"), "POST", "/v1/chat/completions", nil)
+		handler.ServeHTTP(&responseRecorder{head: http.Header{}}, req)
+		audit.Close()
+
+		records := readAuditRecords(t, path)
+		if len(records) != 1 {
+			t.Fatalf("expected one record, got %d", len(records))
+		}
+		rec := records[0]
+		if rec.RequestID != "req_1" || rec.KeyID != auditKeyID([]byte("s3cret"), "ghp_secret") || rec.Model != "gpt-4o" ||
+			rec.Messages != 1 || len(rec.Tools) != 1 || rec.Tools[0] != "get_weather" || rec.Status != http.StatusGatewayTimeout ||
+			rec.Error != "Request timed out" || rec.Usage == nil || rec.Usage.PromptTokens != 5 || rec.Usage.CompletionTokens != 1 || len(rec.FinishReasons) != 1 {
+			t.Errorf("unexpected record %+v", rec)
+		}
+		if captured := rec.Prompt != nil && len(rec.Response) == 1; captured != capture {
+			t.Errorf("expected full capture to be %v, got %+v", capture, rec)
+		}
+		if data, _ := os.ReadFile(path); !capture && strings.Contains(string(data), "weather?") {
+			t.Error("expected prompts to be left out without capture")
+		}
+	}
+}
+
+func TestAuditKeyID(t *testing.T) {
+	if id := auditKeyID(nil, "ghp_secret"); id != "" {
+		t.Errorf("expected keys not to be recorded without a secret, got %q", id)
+	}
+	id := auditKeyID([]byte("s3cret"), "ghp_secret")
+	if !strings.HasPrefix(id, "hmac:") || len(id) != len("hmac:")+16 {
+		t.Errorf("unexpected key ID %q", id)
+	}
+	if auditKeyID([]byte("s3cret"), "ghp_secret") != id {
+		t.Error("expected the key ID to be stable")
+	}
+	if auditKeyID([]byte("other"), "ghp_secret") == id {
+		t.Error("expected the key ID to depend on the secret")
+	}
+}
+
+func TestAuditRequests_KeyID(t *testing.T) {
+	backend := newFakeBackend(
+		[]copilot.SessionEvent{messageEvent("Hi"), idleEvent()},
+		[]copilot.SessionEvent{messageEvent("Hi"), idleEvent()},
+	)
+	srv, ts := newFakeServer(t, backend)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := openAuditLog(path, 0, 0, false, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.audit = audit
+
+	// A key sent in the body is an HMAC under the configured secret
+	postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","api_key":"ghp_body","messages":[{"role":"user","content":"Hi"}]}`)
+
+	// A virtual key is recorded by its ID
+	store, err := openKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, key, err := store.create("ci", "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.keys = store
+	postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","api_key":"`+plain+`","messages":[{"role":"user","content":"Hi"}]}`)
+
+	records := readAuditRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected two records, got %d", len(records))
+	}
+	if want := auditKeyID([]byte("s3cret"), "ghp_body"); records[0].KeyID != want {
+		t.Errorf("got key ID %q for a body key, want %q", records[0].KeyID, want)
+	}
+	if records[1].KeyID != key.ID {
+		t.Errorf("got key ID %q for a virtual key, want %q", records[1].KeyID, key.ID)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// copilotBackend creates the Copilot sessions that serve requests and
+// lists the models they may use. It is implemented by SDK clients, by the
+// recordings served with -replay and, in tests, by a scriptable fake.
+type copilotBackend interface {
+	CreateSession(cfg *copilot.SessionConfig) (copilotSession, error)
+	ListModels() ([]copilot.ModelInfo, error)
+}
+
+// copilotSession is the part of a Copilot session the server drives. The
+// session reports its progress as a stream of events to the handlers
+// registered with On, starting when a prompt is sent.
+type copilotSession interface {
+	ID() string
+	On(handler copilot.SessionEventHandler) func()
+	Send(message copilot.MessageOptions) (string, error)
+	Abort() error
+	Destroy() error
+}
+
+// sdkBackend adapts an SDK client to copilotBackend
+type sdkBackend struct {
+	client *copilot.Client
+}
+
+func (b sdkBackend) CreateSession(cfg *copilot.SessionConfig) (copilotSession, error) {
+	session, err := b.client.CreateSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sdkSession{session}, nil
+}
+
+func (b sdkBackend) ListModels() ([]copilot.ModelInfo, error) {
+	models, err := b.client.ListModels()
+	if err == nil {
+		learnModels(models)
+	}
+	return models, err
+}
+
+// sdkSession adapts an SDK session to copilotSession
+type sdkSession struct {
+	*copilot.Session
+}
+
+func (s sdkSession) ID() string {
+	return s.SessionID
+}
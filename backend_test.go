@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// fakeBackend is a scriptable Copilot backend. Each prompt sent to one of
+// its sessions plays the next script; when a script requests tools, the
+// session calls their handlers, as the CLI does, and continues with the
+// next script once they return.
+type fakeBackend struct {
+	mu      sync.Mutex
+	models  []string
+	scripts [][]copilot.SessionEvent
+	prompts []string
+	created int
+	aborted int
+}
+
+func newFakeBackend(scripts ...[]copilot.SessionEvent) *fakeBackend {
+	return &fakeBackend{models: []string{"gpt-4o"}, scripts: scripts}
+}
+
+func (b *fakeBackend) CreateSession(cfg *copilot.SessionConfig) (copilotSession, error) {
+	return b.session(cfg), nil
+}
+
+func (b *fakeBackend) ListModels() ([]copilot.ModelInfo, error) {
+	models := make([]copilot.ModelInfo, len(b.models))
+	for i, id := range b.models {
+		models[i] = copilot.ModelInfo{ID: id, Name: id}
+	}
+	return models, nil
+}
+
+func (b *fakeBackend) session(cfg *copilot.SessionConfig) *fakeSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.created++
+	s := &fakeSession{backend: b, id: fmt.Sprintf("fake-%d", b.created), tools: make(map[string]copilot.ToolHandler)}
+	for _, tool := range cfg.Tools {
+		s.tools[tool.Name] = tool.Handler
+	}
+	return s
+}
+
+// next pops the next script, or nil when there are none left
+func (b *fakeBackend) next() []copilot.SessionEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.scripts) == 0 {
+		return nil
+	}
+	script := b.scripts[0]
+	b.scripts = b.scripts[1:]
+	return script
+}
+
+type fakeSession struct {
+	backend *fakeBackend
+	id      string
+	tools   map[string]copilot.ToolHandler
+
+	mu       sync.Mutex
+	handlers []copilot.SessionEventHandler
+}
+
+func (s *fakeSession) ID() string     { return s.id }
+func (s *fakeSession) Destroy() error { return nil }
+
+func (s *fakeSession) Abort() error {
+	s.backend.mu.Lock()
+	s.backend.aborted++
+	s.backend.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSession) On(handler copilot.SessionEventHandler) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+	index := len(s.handlers) - 1
+	return func() {
+		s.mu.Lock()
+		s.handlers[index] = nil
+		s.mu.Unlock()
+	}
+}
+
+func (s *fakeSession) Send(message copilot.MessageOptions) (string, error) {
+	s.backend.mu.Lock()
+	s.backend.prompts = append(s.backend.prompts, message.Prompt)
+	s.backend.mu.Unlock()
+	script := s.backend.next()
+	if script == nil {
+		return "", fmt.Errorf("no script left")
+	}
+	go s.play(script)
+	return "message", nil
+}
+
+func (s *fakeSession) play(script []copilot.SessionEvent) {
+	for script != nil {
+		for _, event := range script {
+			s.mu.Lock()
+			handlers := append([]copilot.SessionEventHandler{}, s.handlers...)
+			s.mu.Unlock()
+			for _, h := range handlers {
+				if h != nil {
+					h(event)
+				}
+			}
+		}
+		requests := toolRequests(script)
+		if len(requests) == 0 {
+			return
+		}
+		for _, tr := range requests {
+			s.tools[tr.Name](copilot.ToolInvocation{SessionID: s.id, ToolCallID: tr.ToolCallID, ToolName: tr.Name, Arguments: tr.Arguments})
+		}
+		script = s.backend.next()
+	}
+}
+
+func deltaEvent(text string) copilot.SessionEvent {
+	return copilot.SessionEvent{Type: copilot.AssistantMessageDelta, Data: copilot.Data{DeltaContent: &text}}
+}
+
+func messageEvent(text string, requests ...copilot.ToolRequest) copilot.SessionEvent {
+	return copilot.SessionEvent{Type: copilot.AssistantMessage, Data: copilot.Data{Content: &text, ToolRequests: requests}}
+}
+
+func usageEvent(input, output float64) copilot.SessionEvent {
+	return copilot.SessionEvent{Type: copilot.AssistantUsage, Data: copilot.Data{InputTokens: &input, OutputTokens: &output}}
+}
+
+func errorEvent(message string) copilot.SessionEvent {
+	return copilot.SessionEvent{Type: copilot.SessionError, Data: copilot.Data{Message: &message}}
+}
+
+func idleEvent() copilot.SessionEvent {
+	return copilot.SessionEvent{Type: copilot.SessionIdle}
+}
+
+// newFakeServer serves the full handler chain with backend in place of
+// Copilot
+func newFakeServer(t *testing.T, backend copilotBackend) (*Server, *httptest.Server) {
+	t.Helper()
+	t.Setenv("GH_TOKEN", "")
+	srv, err := NewServer(Config{SessionTTL: time.Minute, MaxSessions: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.backend = backend
+	ts := httptest.NewServer(srv.Handler(logOptions{Redact: newRedactor(nil)}))
+	t.Cleanup(func() {
+		ts.Close()
+		srv.Close()
+	})
+	return srv, ts
+}
+
+func postJSON(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readChunks reads the SSE chunks of a streamed chat completion
+func readChunks(t *testing.T, resp *http.Response) []ChatCompletionChunk {
+	t.Helper()
+	var chunks []ChatCompletionChunk
+	scanner := bufio.NewScanner(resp.Body)
+	done := false
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if !done {
+		t.Error("stream did not end with [DONE]")
+	}
+	return chunks
+}
+
+func TestChatCompletionEndToEnd(t *testing.T) {
+	backend := newFakeBackend([]copilot.SessionEvent{messageEvent("Hello!"), usageEvent(12, 3), idleEvent()})
+	_, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if resp.Header.Get(requestIDHeader) == "" {
+		t.Error("missing request ID header")
+	}
+	var completion ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content != "Hello!" || *choice.FinishReason != "stop" {
+		t.Errorf("choice = %+v", choice)
+	}
+	if completion.Usage == nil || completion.Usage.PromptTokens != 12 || completion.Usage.CompletionTokens != 3 {
+		t.Errorf("usage = %+v", completion.Usage)
+	}
+	if len(backend.prompts) != 1 || !strings.Contains(backend.prompts[0], "Hi") {
+		t.Errorf("prompts = %q", backend.prompts)
+	}
+}
+
+func TestChatCompletionStreamingEndToEnd(t *testing.T) {
+	backend := newFakeBackend([]copilot.SessionEvent{deltaEvent("Hel"), deltaEvent("lo!"), messageEvent("Hello!"), idleEvent()})
+	_, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var content strings.Builder
+	var finish string
+	for _, chunk := range readChunks(t, resp) {
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil {
+				content.WriteString(choice.Delta.Content)
+			}
+			if choice.FinishReason != nil {
+				finish = *choice.FinishReason
+			}
+		}
+	}
+	if content.String() != "Hello!" || finish != "stop" {
+		t.Errorf("streamed %q, finish_reason %q", content.String(), finish)
+	}
+}
+
+func TestChatCompletionToolCallsEndToEnd(t *testing.T) {
+	call := copilot.ToolRequest{Name: "get_weather", ToolCallID: "call_1", Arguments: map[string]interface{}{"city": "Paris"}}
+	backend := newFakeBackend(
+		[]copilot.SessionEvent{messageEvent("", call)},
+		[]copilot.SessionEvent{deltaEvent("Sunny"), messageEvent("Sunny"), idleEvent()},
+	)
+	_, ts := newFakeServer(t, backend)
+
+	tools := `"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]`
+	resp := postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true,`+tools+`,"messages":[{"role":"user","content":"Weather?"}]}`)
+	var calls []ToolCall
+	var finish string
+	for _, chunk := range readChunks(t, resp) {
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				finish = *choice.FinishReason
+			}
+			if choice.Delta == nil {
+				continue
+			}
+			// Arguments follow the chunk that opens the call
+			for _, tc := range choice.Delta.ToolCalls {
+				if tc.ID != "" {
+					calls = append(calls, tc)
+				} else if len(calls) > 0 {
+					calls[len(calls)-1].Function.Arguments += tc.Function.Arguments
+				}
+			}
+		}
+	}
+	if len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Function.Arguments != `{"city":"Paris"}` || finish != "tool_calls" {
+		t.Fatalf("tool calls = %+v, finish_reason %q", calls, finish)
+	}
+
+	// The tool result resumes the parked session instead of a new one
+	resp = postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true,`+tools+`,"messages":[`+
+		`{"role":"user","content":"Weather?"},`+
+		`{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},`+
+		`{"role":"tool","tool_call_id":"call_1","content":"22C and sunny"}]}`)
+	var content strings.Builder
+	for _, chunk := range readChunks(t, resp) {
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil {
+				content.WriteString(choice.Delta.Content)
+			}
+		}
+	}
+	if content.String() != "Sunny" {
+		t.Errorf("content after tool result = %q", content.String())
+	}
+	if backend.created != 1 || len(backend.prompts) != 1 {
+		t.Errorf("created %d sessions and sent %d prompts, want 1 and 1", backend.created, len(backend.prompts))
+	}
+}
+
+func TestChatCompletionErrorsEndToEnd(t *testing.T) {
+	capiError := "Execution failed: Last error: CAPIError: 429 429 Too Many Requests"
+	backend := newFakeBackend(
+		[]copilot.SessionEvent{errorEvent(capiError)},
+		[]copilot.SessionEvent{errorEvent(capiError)},
+		[]copilot.SessionEvent{deltaEvent("One, "), deltaEvent("two. Three"), messageEvent("One, two. Three"), idleEvent()},
+	)
+	_, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("non-streaming status = %d, want 429", resp.StatusCode)
+	}
+
+	// Nothing was streamed yet, so the error is still a plain response
+	resp = postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("streaming status = %d, want 429", resp.StatusCode)
+	}
+
+	// A stop sequence cuts the stream and aborts the session
+	resp = postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true,"stop":".","messages":[{"role":"user","content":"Count"}]}`)
+	var content strings.Builder
+	for _, chunk := range readChunks(t, resp) {
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil {
+				content.WriteString(choice.Delta.Content)
+			}
+		}
+	}
+	if content.String() != "One, two" || backend.aborted != 1 {
+		t.Errorf("streamed %q with %d aborts, want %q and 1", content.String(), backend.aborted, "One, two")
+	}
+}
+
+func TestModelsEndToEnd(t *testing.T) {
+	backend := newFakeBackend()
+	backend.models = []string{"gpt-4o", "claude-sonnet-4"}
+	_, ts := newFakeServer(t, backend)
+
+	resp, err := http.Get(ts.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var models ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		t.Fatal(err)
+	}
+	if len(models.Data) != 2 || models.Data[1].ID != "claude-sonnet-4" {
+		t.Errorf("models = %+v", models.Data)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// clientPingTimeout bounds a health check of a Copilot client
+const clientPingTimeout = 10 * time.Second
+
+// maxClientStarts bounds how many clients the pool starts at once, so a
+// burst of requests with distinct tokens cannot spawn an unbounded number
+// of Copilot CLI processes
+const maxClientStarts = 4
+
+// clientPool holds a Copilot client per GitHub token supplied by callers,
+// keyed by hashToken so raw tokens are never used as map keys.
+// Every client runs its own Copilot CLI process, so the pool is bounded:
+// idle clients expire after ttl and the least recently used client is
+// evicted when there are more than maxSize. Clients are counted while
+// requests use them; one evicted in use is only stopped once the last
+// request releases it. The zero value is an unbounded pool that never
+// expires clients.
+type clientPool struct {
+	mu      sync.Mutex
+	entries map[string]*pooledClient
+	maxSize int
+	ttl     time.Duration
+	// starting holds the starts in progress by token hash, so requests
+	// with the same token wait for one start, and startSlots limits the
+	// starts in progress to maxClientStarts
+	starting   map[string]*clientStart
+	startSlots chan struct{}
+	// start creates and starts the client for a token and stop kills
+	// it; nil means startClient and ForceStop
+	start func(token string) (*copilot.Client, error)
+	stop  func(*copilot.Client)
+	// onStop is called with every client the pool stops, so sessions
+	// that belong to it can be dropped
+	onStop func(*copilot.Client)
+}
+
+// pooledClient is a client together with the token it was started with,
+// so it can be restarted. The token is never logged.
+type pooledClient struct {
+	client   *copilot.Client
+	token    string
+	lastUsed time.Time
+	// users counts the requests using the client, and evicted is set
+	// when it was evicted while in use and must be stopped by the last
+	users   int
+	evicted bool
+}
+
+// clientStart is a client start in progress
+type clientStart struct {
+	done chan struct{}
+	err  error
+}
+
+// newClientPool returns a pool of at most maxSize clients that stops
+// clients idle for longer than ttl. Zero disables either limit.
+func newClientPool(maxSize int, ttl time.Duration) *clientPool {
+	return &clientPool{maxSize: maxSize, ttl: ttl}
+}
+
+// startClient starts a Copilot client for token and checks that the
+// token is accepted by listing models, so clients that fail to
+// authenticate are never cached.
+func startClient(token string) (*copilot.Client, error) {
+	client := copilot.NewClient(&copilot.ClientOptions{
+		LogLevel: "error",
+		Env:      buildClientEnv(token),
+	})
+	if err := client.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start copilot client: %w", err)
+	}
+	models, err := client.ListModels()
+	if err != nil {
+		client.ForceStop()
+		return nil, fmt.Errorf("copilot client failed to authenticate: %w", err)
+	}
+	learnModels(models)
+	return client, nil
+}
+
+// get returns the client for token, starting one if needed, and a
+// function the caller must call once it no longer uses the client
+func (p *clientPool) get(ctx context.Context, token string) (*copilot.Client, func(), error) {
+	key := hashToken(token)
+	for {
+		p.mu.Lock()
+		if entry, ok := p.entries[key]; ok {
+			client, release := p.acquire(entry)
+			p.mu.Unlock()
+			return client, release, nil
+		}
+		if pending, ok := p.starting[key]; ok {
+			p.mu.Unlock()
+			select {
+			case <-pending.done:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			// A start given up by its own caller is retried
+			if pending.err != nil && !errors.Is(pending.err, context.Canceled) {
+				return nil, nil, pending.err
+			}
+			continue
+		}
+		pending := &clientStart{done: make(chan struct{})}
+		if p.starting == nil {
+			p.starting = make(map[string]*clientStart)
+		}
+		p.starting[key] = pending
+		p.mu.Unlock()
+
+		client, release, err := p.add(ctx, key, token)
+		p.mu.Lock()
+		delete(p.starting, key)
+		p.mu.Unlock()
+		pending.err = err
+		close(pending.done)
+		return client, release, err
+	}
+}
+
+// add starts a client for token and pools it, evicting the least
+// recently used clients if the pool is full
+func (p *clientPool) add(ctx context.Context, key, token string) (*copilot.Client, func(), error) {
+	p.mu.Lock()
+	if p.startSlots == nil {
+		p.startSlots = make(chan struct{}, maxClientStarts)
+	}
+	slots, start := p.startSlots, p.start
+	p.mu.Unlock()
+	if start == nil {
+		start = startClient
+	}
+
+	// Start outside the lock: it spawns a process and talks to GitHub
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	client, err := start(token)
+	<-slots
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stopped []*copilot.Client
+	p.mu.Lock()
+	if p.entries == nil {
+		p.entries = make(map[string]*pooledClient)
+	}
+	entry := &pooledClient{client: client, token: token}
+	p.entries[key] = entry
+	for p.maxSize > 0 && len(p.entries) > p.maxSize {
+		oldest := ""
+		for k, e := range p.entries {
+			if k != key && (oldest == "" || e.lastUsed.Before(p.entries[oldest].lastUsed)) {
+				oldest = k
+			}
+		}
+		if c := p.evict(oldest); c != nil {
+			stopped = append(stopped, c)
+		}
+	}
+	client, release := p.acquire(entry)
+	p.mu.Unlock()
+
+	if len(stopped) > 0 {
+		slog.Debug("Client pool full, stopping least recently used clients", "count", len(stopped))
+	}
+	p.stopAll(stopped)
+	return client, release, nil
+}
+
+// acquire counts a user of entry and returns its client with the function
+// releasing it. p.mu must be held.
+func (p *clientPool) acquire(entry *pooledClient) (*copilot.Client, func()) {
+	entry.users++
+	entry.lastUsed = time.Now()
+	var once sync.Once
+	return entry.client, func() { once.Do(func() { p.release(entry) }) }
+}
+
+// release ends a use of entry, stopping its client if it was evicted and
+// this was the last use
+func (p *clientPool) release(entry *pooledClient) {
+	p.mu.Lock()
+	entry.users--
+	entry.lastUsed = time.Now()
+	stop := entry.evicted && entry.users == 0
+	p.mu.Unlock()
+	if stop {
+		p.stopAll([]*copilot.Client{entry.client})
+	}
+}
+
+// evict removes the entry under key from the pool and returns its client
+// if it can be stopped now. A client in use is left to its last user.
+// p.mu must be held.
+func (p *clientPool) evict(key string) *copilot.Client {
+	entry := p.entries[key]
+	delete(p.entries, key)
+	if entry.users > 0 {
+		entry.evicted = true
+		return nil
+	}
+	return entry.client
+}
+
+// stopAll stops clients removed from the pool
+func (p *clientPool) stopAll(clients []*copilot.Client) {
+	for _, client := range clients {
+		if p.onStop != nil {
+			p.onStop(client)
+		}
+		if p.stop != nil {
+			p.stop(client)
+		} else {
+			client.ForceStop()
+		}
+	}
+}
+
+// evictExpired stops clients that have been idle longer than the TTL.
+// Clients in use are never idle.
+func (p *clientPool) evictExpired(now time.Time) {
+	if p.ttl <= 0 {
+		return
+	}
+	var expired []*copilot.Client
+	p.mu.Lock()
+	for key, entry := range p.entries {
+		if entry.users == 0 && now.Sub(entry.lastUsed) > p.ttl {
+			expired = append(expired, p.evict(key))
+		}
+	}
+	p.mu.Unlock()
+
+	if len(expired) > 0 {
+		slog.Debug("Stopping idle Copilot clients", "count", len(expired))
+	}
+	p.stopAll(expired)
+}
+
+// checkHealth pings every client and restarts the ones whose CLI process
+// has died. A client that cannot be restarted is dropped, so the next
+// request with its token starts a new one.
+func (p *clientPool) checkHealth() {
+	p.mu.Lock()
+	entries := make([]pooledClient, 0, len(p.entries))
+	for _, entry := range p.entries {
+		entries = append(entries, *entry)
+	}
+	start := p.start
+	p.mu.Unlock()
+	if start == nil {
+		start = startClient
+	}
+
+	for _, entry := range entries {
+		if clientHealthy(entry.client) {
+			continue
+		}
+		slog.Warn("Copilot client is unhealthy, restarting", "fingerprint", tokenFingerprint(entry.token))
+		p.stopAll([]*copilot.Client{entry.client})
+		restarted, err := start(entry.token)
+
+		key := hashToken(entry.token)
+		p.mu.Lock()
+		current, ok := p.entries[key]
+		switch {
+		case !ok || current.client != entry.client:
+			// Replaced or removed in the meantime
+			p.mu.Unlock()
+			if restarted != nil {
+				p.stopAll([]*copilot.Client{restarted})
+			}
+			continue
+		case err != nil:
+			slog.Error("Restarting Copilot client failed", "fingerprint", tokenFingerprint(entry.token), "error", err)
+			delete(p.entries, key)
+		default:
+			current.client = restarted
+		}
+		p.mu.Unlock()
+	}
+}
+
+// clientHealthy reports whether a client is connected and answers a ping
+func clientHealthy(client *copilot.Client) bool {
+	if client.GetState() != copilot.StateConnected {
+		return false
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Ping("health")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(clientPingTimeout):
+		return false
+	}
+}
+
+// remove stops and drops the client whose token has the given
+// fingerprint, even if requests are still using it. It reports false if
+// there is no such client.
+func (p *clientPool) remove(fingerprint string) bool {
+	p.mu.Lock()
+	var client *copilot.Client
+	for key, entry := range p.entries {
+		if tokenFingerprint(entry.token) == fingerprint {
+			client = entry.client
+			delete(p.entries, key)
+			break
+		}
+	}
+	p.mu.Unlock()
+	if client == nil {
+		return false
+	}
+	p.stopAll([]*copilot.Client{client})
+	return true
+}
+
+// fingerprints returns the fingerprints of the pooled clients' tokens
+func (p *clientPool) fingerprints() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fingerprints := make([]string, 0, len(p.entries))
+	for _, entry := range p.entries {
+		fingerprints = append(fingerprints, tokenFingerprint(entry.token))
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// Len returns the number of pooled clients
+func (p *clientPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// Close stops every pooled client
+func (p *clientPool) Close() {
+	p.mu.Lock()
+	entries := p.entries
+	p.entries = nil
+	p.mu.Unlock()
+	for _, entry := range entries {
+		entry.client.Stop()
+	}
+}
+
+// monitorClients expires idle clients and restarts dead ones, including
+// the default client, every interval until done is closed.
+func (s *Server) monitorClients(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.clients.evictExpired(time.Now())
+			s.clients.checkHealth()
+			s.checkDefaultClient()
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkDefaultClient restarts the GH_TOKEN client if its CLI process has
+// died. The old client keeps serving until the new one has started.
+func (s *Server) checkDefaultClient() {
+	s.mu.Lock()
+	client := s.defaultClient
+	s.mu.Unlock()
+	if client == nil || clientHealthy(client) {
+		return
+	}
+	slog.Warn("Default Copilot client is unhealthy, restarting")
+	restarted, err := startClient(s.defaultToken)
+	if err != nil {
+		slog.Error("Restarting default Copilot client failed", "error", err)
+		return
+	}
+	s.sessions.remove(func(l *liveSession) bool { return l.client == (sdkBackend{client}) })
+	s.mu.Lock()
+	s.defaultClient = restarted
+	s.mu.Unlock()
+	client.ForceStop()
+}
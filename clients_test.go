@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// fakePool returns a pool whose clients are never started, recording the
+// clients it stops
+func fakePool(maxSize int, ttl time.Duration, stopped *[]*copilot.Client) *clientPool {
+	pool := newClientPool(maxSize, ttl)
+	pool.start = func(token string) (*copilot.Client, error) {
+		if token == "bad" {
+			return nil, errors.New("authentication failed")
+		}
+		return &copilot.Client{}, nil
+	}
+	pool.stop = func(client *copilot.Client) { *stopped = append(*stopped, client) }
+	return pool
+}
+
+// use gets the client for token and releases it again, like a request
+// that has completed
+func use(pool *clientPool, token string) (*copilot.Client, error) {
+	client, release, err := pool.get(context.Background(), token)
+	if err == nil {
+		release()
+	}
+	return client, err
+}
+
+func TestClientPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	var stopped []*copilot.Client
+	pool := fakePool(2, 0, &stopped)
+
+	a, _ := use(pool, "a")
+	use(pool, "b")
+	time.Sleep(time.Millisecond)
+	if again, _ := use(pool, "a"); again != a {
+		t.Fatal("expected the cached client to be reused")
+	}
+	use(pool, "c")
+
+	if pool.Len() != 2 || len(stopped) != 1 {
+		t.Fatalf("expected one client to be evicted, pool has %d, stopped %d", pool.Len(), len(stopped))
+	}
+	if stopped[0] == a {
+		t.Error("expected the least recently used client to be evicted")
+	}
+}
+
+func TestClientPoolDoesNotCacheFailures(t *testing.T) {
+	var stopped []*copilot.Client
+	pool := fakePool(0, 0, &stopped)
+	if _, err := use(pool, "bad"); err == nil {
+		t.Fatal("expected the failed client to be reported")
+	}
+	if pool.Len() != 0 {
+		t.Error("expected a client that failed to authenticate not to be cached")
+	}
+}
+
+func TestClientPoolExpiresIdleClients(t *testing.T) {
+	var stopped []*copilot.Client
+	pool := fakePool(0, time.Minute, &stopped)
+	var dropped int
+	pool.onStop = func(*copilot.Client) { dropped++ }
+
+	use(pool, "a")
+	pool.evictExpired(time.Now())
+	if pool.Len() != 1 {
+		t.Fatal("expected a fresh client to be kept")
+	}
+	pool.evictExpired(time.Now().Add(2 * time.Minute))
+	if pool.Len() != 0 || len(stopped) != 1 || dropped != 1 {
+		t.Errorf("expected the idle client to be stopped, pool has %d", pool.Len())
+	}
+}
+
+func TestClientPoolRestartsUnhealthyClients(t *testing.T) {
+	var stopped []*copilot.Client
+	pool := fakePool(0, 0, &stopped)
+	dead, _ := use(pool, "a")
+
+	// A client that was never started is not connected
+	pool.checkHealth()
+	restarted, _ := use(pool, "a")
+	if restarted == dead || len(stopped) != 1 || stopped[0] != dead {
+		t.Error("expected the dead client to be stopped and replaced")
+	}
+}
+
+func TestClientPoolDefersStoppingClientsInUse(t *testing.T) {
+	var stopped []*copilot.Client
+	pool := fakePool(1, time.Minute, &stopped)
+
+	a, release, _ := pool.get(context.Background(), "a")
+	pool.evictExpired(time.Now().Add(2 * time.Minute))
+	if pool.Len() != 1 {
+		t.Fatal("expected a client in use not to expire")
+	}
+	use(pool, "b")
+	if pool.Len() != 1 || len(stopped) != 0 {
+		t.Fatalf("expected the evicted client to keep running while in use, stopped %d", len(stopped))
+	}
+	release()
+	release()
+	if len(stopped) != 1 || stopped[0] != a {
+		t.Errorf("expected the evicted client to be stopped once on release, stopped %d", len(stopped))
+	}
+}
+
+func TestClientPoolLimitsConcurrentStarts(t *testing.T) {
+	var stopped []*copilot.Client
+	pool := fakePool(0, 0, &stopped)
+	var mu sync.Mutex
+	starts, running, peak := map[string]int{}, 0, 0
+	unblock := make(chan struct{})
+	pool.start = func(token string) (*copilot.Client, error) {
+		mu.Lock()
+		starts[token]++
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		<-unblock
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return &copilot.Client{}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3*maxClientStarts; i++ {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			use(pool, token)
+		}(string(rune('a' + i%(2*maxClientStarts))))
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	if peak > maxClientStarts {
+		t.Errorf("%d clients started at once, want at most %d", peak, maxClientStarts)
+	}
+	for token, n := range starts {
+		if n != 1 {
+			t.Errorf("client for %q started %d times, want once", token, n)
+		}
+	}
+	if pool.Len() != 2*maxClientStarts {
+		t.Errorf("pool has %d clients, want %d", pool.Len(), 2*maxClientStarts)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// maxCompletionChoices bounds n times the number of prompts, since every
+// choice costs a separate Copilot session.
+const maxCompletionChoices = 16
+
+// Copilot only offers chat models, so legacy completions are emulated by
+// asking the model to continue (or fill in) the prompt verbatim.
+const (
+	completionSystemMessage = "You are a text completion engine. Continue the user's text exactly where it ends. " +
+		"Reply with the continuation only, without repeating the text or adding any commentary."
+	insertionSystemMessage = "You are a text completion engine. Write the text that belongs between the given [Prefix] and [Suffix]. " +
+		"Reply with the inserted text only, without repeating the prefix or suffix or adding any commentary."
+)
+
+// completionPrompts decodes the legacy `prompt` value, which may be a
+// string or an array of strings. Token-array prompts are rejected since
+// the server has no tokenizer to decode them.
+func completionPrompts(v interface{}) ([]string, error) {
+	switch prompt := v.(type) {
+	case string:
+		return []string{prompt}, nil
+	case []interface{}:
+		prompts := make([]string, 0, len(prompt))
+		for _, item := range prompt {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("token prompts are not supported; send the prompt as text")
+			}
+			prompts = append(prompts, s)
+		}
+		return prompts, nil
+	default:
+		return nil, fmt.Errorf("prompt must be a string or an array of strings")
+	}
+}
+
+// runCompletion completes a single prompt on its own session
+func (s *Server) runCompletion(ctx context.Context, client copilotBackend, model, prompt, suffix string, stream bool, opts turnOptions) (*turnResult, error) {
+	system, text := completionSystemMessage, prompt
+	if suffix != "" {
+		system = insertionSystemMessage
+		text = fmt.Sprintf("[Prefix]:\n%s\n\n[Suffix]:\n%s", prompt, suffix)
+	}
+	messages := []Message{
+		{Role: "system", Content: system},
+		{Role: "user", Content: text},
+	}
+
+	newSession := func() (copilotSession, error) {
+		session, err := s.createSession(ctx, client, model, sessionConfigFor(model, messages, nil, stream))
+		if err != nil {
+			slog.ErrorContext(ctx, "Creating session failed", "model", model, "error", err)
+			return nil, fmt.Errorf("%w: %v", errCreateSession, err)
+		}
+		s.requests.attach(ctx, session, model)
+		return session, nil
+	}
+	session, err := newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { session.Destroy() }()
+
+	opts.Messages = messages
+	ctx, span := startTurnSpan(ctx, "text_completion", model, session.ID(), opts)
+	result, err := s.config.Retry.run(ctx, opts, func(opts turnOptions) (*turnResult, error) {
+		return runTurn(ctx, session, copilot.MessageOptions{Prompt: text}, opts)
+	}, func() error {
+		next, err := newSession()
+		if err != nil {
+			return err
+		}
+		session.Destroy()
+		session = next
+		return nil
+	})
+	observeTurn(ctx, result, err)
+	endTurnSpan(span, result, err)
+	auditTurn(ctx, conversationRequest{Model: model, Messages: messages}, result, err)
+	return result, err
+}
+
+// HandleCompletions handles POST /v1/completions
+func (s *Server) HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error")
+		return
+	}
+
+	var req CompletionRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body", "invalid_request_error")
+		return
+	}
+
+	// enforce API key, either header or body
+	apiKey := getAPIKeyFromHeader(r)
+	if apiKey == "" {
+		apiKey = req.ApiKey
+	}
+	client, err := s.clientFor(r.Context(), apiKey, req.Model)
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return
+	}
+	labelRequest(r.Context(), req.Model, req.Stream)
+
+	if req.Model == "" {
+		writeError(w, http.StatusBadRequest, "Model is required", "invalid_request_error")
+		return
+	}
+
+	prompts, err := completionPrompts(req.Prompt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	if len(prompts) == 0 {
+		writeError(w, http.StatusBadRequest, "Prompt is required", "invalid_request_error")
+		return
+	}
+
+	n := 1
+	if req.N != nil {
+		n = *req.N
+	}
+	if n < 1 || n*len(prompts) > maxCompletionChoices {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("n times the number of prompts must be between 1 and %d", maxCompletionChoices), "invalid_request_error")
+		return
+	}
+
+	stops, err := parseStop(req.Stop)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	maxTokens, err := parseMaxTokens("max_tokens", req.MaxTokens)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	opts := turnOptions{Stop: stops, MaxTokens: maxTokens}
+
+	completionID := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+	if req.Stream {
+		s.handleStreamingCompletions(r.Context(), w, client, &req, completionID, prompts, n, opts)
+	} else {
+		s.handleNonStreamingCompletions(r.Context(), w, client, &req, completionID, prompts, n, opts)
+	}
+}
+
+// handleNonStreamingCompletions runs every choice and writes a single
+// text_completion response. Choice i completes prompt i/n.
+func (s *Server) handleNonStreamingCompletions(ctx context.Context, w http.ResponseWriter, client copilotBackend, req *CompletionRequest, completionID string, prompts []string, n int, opts turnOptions) {
+	total := len(prompts) * n
+	results := make([]*turnResult, total)
+	errs := make([]error, total)
+	forEachChoice(total, func(i int) {
+		results[i], errs[i] = s.runCompletion(ctx, client, req.Model, prompts[i/n], req.Suffix, false, opts)
+	})
+
+	for _, err := range errs {
+		if err != nil {
+			status, msg := turnErrorStatus(err)
+			writeError(w, status, msg, openAIErrorTypeForStatus(status))
+			return
+		}
+	}
+
+	response := CompletionResponse{
+		ID:      completionID,
+		Object:  "text_completion",
+		Created: currentTimestamp(),
+		Model:   req.Model,
+		Choices: make([]CompletionChoice, total),
+	}
+	for i, result := range results {
+		text := result.Content
+		if req.Echo {
+			text = prompts[i/n] + text
+		}
+		response.Choices[i] = CompletionChoice{
+			Text:         text,
+			Index:        i,
+			FinishReason: &result.FinishReason,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleStreamingCompletions streams every choice as legacy
+// text_completion chunks, interleaved and told apart by index.
+func (s *Server) handleStreamingCompletions(ctx context.Context, w http.ResponseWriter, client copilotBackend, req *CompletionRequest, completionID string, prompts []string, n int, base turnOptions) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported", "api_error")
+		return
+	}
+
+	// Choices stream concurrently, so writes are serialized
+	var mu sync.Mutex
+	headersSent := false
+	var firstErr error
+	var failed []int
+
+	sendChunk := func(index int, text string, finishReason *string) {
+		if !headersSent {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("X-Accel-Buffering", "no")
+			headersSent = true
+		}
+		chunk := CompletionResponse{
+			ID:      completionID,
+			Object:  "text_completion",
+			Created: currentTimestamp(),
+			Model:   req.Model,
+			Choices: []CompletionChoice{{
+				Text:         text,
+				Index:        index,
+				FinishReason: finishReason,
+			}},
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	total := len(prompts) * n
+	forEachChoice(total, func(i int) {
+		prompt := prompts[i/n]
+		echoed := !req.Echo
+		// send writes a chunk for this choice, echoing the prompt first
+		// when requested
+		send := func(text string, finishReason *string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !echoed {
+				echoed = true
+				sendChunk(i, prompt, nil)
+			}
+			sendChunk(i, text, finishReason)
+		}
+
+		opts := base
+		opts.OnDelta = func(delta string) { send(delta, nil) }
+		result, err := s.runCompletion(ctx, client, req.Model, prompt, req.Suffix, true, opts)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			if headersSent {
+				sendChunk(i, "", strPtr("error"))
+			} else {
+				failed = append(failed, i)
+			}
+			mu.Unlock()
+			return
+		}
+		send("", &result.FinishReason)
+	})
+
+	if !headersSent && firstErr != nil {
+		status, msg := turnErrorStatus(firstErr)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return
+	}
+	// Choices that failed before anything was streamed still need a
+	// terminating chunk once other choices have started the stream
+	for _, i := range failed {
+		sendChunk(i, "", strPtr("error"))
+	}
+
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestCompletionPrompts(t *testing.T) {
+	got, err := completionPrompts("Once upon a time")
+	if err != nil || len(got) != 1 || got[0] != "Once upon a time" {
+		t.Fatalf("string prompt: got %v, err %v", got, err)
+	}
+
+	got, err = completionPrompts([]interface{}{"a", "b"})
+	if err != nil || len(got) != 2 || got[1] != "b" {
+		t.Fatalf("array prompt: got %v, err %v", got, err)
+	}
+
+	if _, err := completionPrompts([]interface{}{float64(1212), float64(318)}); err == nil {
+		t.Fatal("expected error for token prompt")
+	}
+	if _, err := completionPrompts(nil); err == nil {
+		t.Fatal("expected error for missing prompt")
+	}
+}
+
+func TestParseStop(t *testing.T) {
+	if got, err := parseStop("\n"); err != nil || len(got) != 1 || got[0] != "\n" {
+		t.Fatalf("string stop: got %v, err %v", got, err)
+	}
+	if got, err := parseStop([]interface{}{"a", "b"}); err != nil || len(got) != 2 {
+		t.Fatalf("array stop: got %v, err %v", got, err)
+	}
+	if got, err := parseStop(nil); err != nil || got != nil {
+		t.Fatalf("nil stop: got %v, err %v", got, err)
+	}
+	if _, err := parseStop([]interface{}{"a", "b", "c", "d", "e"}); err == nil {
+		t.Fatal("expected error for too many stop sequences")
+	}
+	if _, err := parseStop(float64(3)); err == nil {
+		t.Fatal("expected error for non-string stop")
+	}
+}
+
+func TestForEachChoice_BoundedConcurrency(t *testing.T) {
+	var inFlight, peak, calls int32
+	forEachChoice(20, func(index int) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		atomic.AddInt32(&calls, 1)
+		atomic.AddInt32(&inFlight, -1)
+	})
+	if calls != 20 {
+		t.Fatalf("expected 20 calls, got %d", calls)
+	}
+	if peak > maxParallelSessions {
+		t.Fatalf("expected at most %d concurrent calls, got %d", maxParallelSessions, peak)
+	}
+}
+
+func TestHandleCompletions_Validation(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "Missing model", body: `{"prompt":"hi"}`},
+		{name: "Token prompt", body: `{"model":"gpt-4o","prompt":[1,2,3]}`},
+		{name: "Too many choices", body: `{"model":"gpt-4o","prompt":["a","b"],"n":9}`},
+		{name: "Invalid stop", body: `{"model":"gpt-4o","prompt":"hi","stop":5}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/v1/completions", strings.NewReader(tt.body))
+			rw := &responseRecorder{head: http.Header{}}
+			srv.HandleCompletions(rw, req)
+			if rw.status != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d: %s", rw.status, rw.body.String())
+			}
+		})
+	}
+}
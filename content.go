@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// imageExtensions maps the image MIME types accepted in data: URLs to the
+// file extension used for the temporary attachment, so the Copilot CLI can
+// recognise the file as an image.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/jpg":  ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// UnmarshalJSON accepts message content either as a plain string or as an
+// array of content parts. Text parts are flattened into Content so the rest
+// of the server can keep treating content as text; the parts themselves are
+// kept in Parts for attachment handling.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type alias Message
+	aux := struct {
+		*alias
+		Content json.RawMessage `json:"content"`
+	}{alias: (*alias)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Content = ""
+	m.Parts = nil
+	raw := strings.TrimSpace(string(aux.Content))
+	switch {
+	case raw == "" || raw == "null":
+		return nil
+	case strings.HasPrefix(raw, "["):
+		if err := json.Unmarshal(aux.Content, &m.Parts); err != nil {
+			return fmt.Errorf("invalid content parts: %w", err)
+		}
+		m.Content = flattenContentParts(m.Parts)
+		return nil
+	default:
+		return json.Unmarshal(aux.Content, &m.Content)
+	}
+}
+
+// flattenContentParts joins the text parts of an array-form content.
+func flattenContentParts(parts []ContentPart) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" && part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// imageAttachments converts the image parts of user messages into Copilot
+// file attachments. data: URLs are decoded into a temporary directory that
+// the returned cleanup function removes; local files (file:// URLs or
+// absolute paths) are attached in place, but only when they live under
+// imageDir. An empty imageDir disables local files entirely so clients
+// cannot attach arbitrary files from the server's filesystem.
+func imageAttachments(messages []Message, imageDir string) ([]copilot.Attachment, func(), error) {
+	var attachments []copilot.Attachment
+	var tempDir string
+	cleanup := func() {
+		if tempDir != "" {
+			os.RemoveAll(tempDir)
+		}
+	}
+
+	for _, msg := range messages {
+		if msg.Role != "user" {
+			continue
+		}
+		for _, part := range msg.Parts {
+			if part.Type != "image_url" || part.ImageURL == nil {
+				continue
+			}
+			url := part.ImageURL.URL
+			name := fmt.Sprintf("image-%d", len(attachments)+1)
+
+			var path string
+			switch {
+			case strings.HasPrefix(url, "data:"):
+				if tempDir == "" {
+					dir, err := os.MkdirTemp("", "copilot-images-")
+					if err != nil {
+						cleanup()
+						return nil, nil, fmt.Errorf("failed to store image: %w", err)
+					}
+					tempDir = dir
+				}
+				p, err := writeDataURL(tempDir, name, url)
+				if err != nil {
+					cleanup()
+					return nil, nil, err
+				}
+				path = p
+			case strings.HasPrefix(url, "file://") || filepath.IsAbs(url):
+				p, err := resolveLocalImage(strings.TrimPrefix(url, "file://"), imageDir)
+				if err != nil {
+					cleanup()
+					return nil, nil, err
+				}
+				path = p
+				name = filepath.Base(p)
+			default:
+				cleanup()
+				return nil, nil, fmt.Errorf("unsupported image URL; send images as data: URLs")
+			}
+
+			attachments = append(attachments, copilot.Attachment{
+				Type:        copilot.File,
+				Path:        path,
+				DisplayName: name,
+			})
+		}
+	}
+
+	return attachments, cleanup, nil
+}
+
+// writeDataURL decodes a base64 data: URL into dir and returns the file path.
+func writeDataURL(dir, name, url string) (string, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return "", fmt.Errorf("image data URLs must be base64 encoded")
+	}
+	mimeType := strings.ToLower(strings.TrimSuffix(header, ";base64"))
+	ext, ok := imageExtensions[mimeType]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type %q", mimeType)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 image data")
+	}
+
+	path := filepath.Join(dir, name+ext)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to store image: %w", err)
+	}
+	return path, nil
+}
+
+// resolveLocalImage checks that path is an existing file under imageDir and
+// returns its cleaned absolute form.
+func resolveLocalImage(path, imageDir string) (string, error) {
+	if imageDir == "" {
+		return "", fmt.Errorf("local image files are not enabled on this server")
+	}
+	root, err := filepath.EvalSymlinks(imageDir)
+	if err != nil {
+		return "", fmt.Errorf("local image files are not enabled on this server")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", fmt.Errorf("image file not found: %s", path)
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("image file is outside the allowed directory: %s", path)
+	}
+	if info, err := os.Stat(resolved); err != nil || info.IsDir() {
+		return "", fmt.Errorf("image file not found: %s", path)
+	}
+	return resolved, nil
+}
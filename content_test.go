@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageUnmarshal_ContentForms(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		want      string
+		wantParts int
+	}{
+		{
+			name: "Plain string",
+			body: `{"role":"user","content":"Hello"}`,
+			want: "Hello",
+		},
+		{
+			name: "Null content",
+			body: `{"role":"assistant","content":null,"tool_calls":[]}`,
+			want: "",
+		},
+		{
+			name:      "Text and image parts",
+			body:      `{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}},{"type":"text","text":"Be brief."}]}`,
+			want:      "What is this?\nBe brief.",
+			wantParts: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg Message
+			if err := json.Unmarshal([]byte(tt.body), &msg); err != nil {
+				t.Fatalf("unmarshal failed: %v", err)
+			}
+			if msg.Content != tt.want {
+				t.Errorf("Content = %q, want %q", msg.Content, tt.want)
+			}
+			if len(msg.Parts) != tt.wantParts {
+				t.Errorf("len(Parts) = %d, want %d", len(msg.Parts), tt.wantParts)
+			}
+		})
+	}
+}
+
+func TestImageAttachments_DataURL(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,aGk="}}}},
+		{Role: "user", Parts: []ContentPart{
+			{Type: "text", Text: "look"},
+			{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/jpeg;base64,aGVsbG8="}},
+		}},
+	}
+
+	attachments, cleanup, err := imageAttachments(messages, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("expected 1 attachment (user messages only), got %d", len(attachments))
+	}
+
+	path := attachments[0].Path
+	if !strings.HasSuffix(path, ".jpg") {
+		t.Errorf("expected .jpg extension, got %q", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("attachment content mismatch: %q, %v", data, err)
+	}
+
+	cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected temporary image to be removed, stat err: %v", err)
+	}
+}
+
+func TestImageAttachments_Rejections(t *testing.T) {
+	dir := t.TempDir()
+	inside := filepath.Join(dir, "cat.png")
+	if err := os.WriteFile(inside, []byte("png"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.png")
+	if err := os.WriteFile(outside, []byte("png"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		imageDir string
+		wantErr  bool
+	}{
+		{name: "Remote URL", url: "https://example.com/cat.png", wantErr: true},
+		{name: "Non-base64 data URL", url: "data:image/png,raw", wantErr: true},
+		{name: "Non-image data URL", url: "data:text/plain;base64,aGk=", wantErr: true},
+		{name: "Local file disabled", url: inside, wantErr: true},
+		{name: "Local file outside image dir", url: outside, imageDir: dir, wantErr: true},
+		{name: "Local file inside image dir", url: "file://" + inside, imageDir: dir},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := []Message{{Role: "user", Parts: []ContentPart{
+				{Type: "image_url", ImageURL: &ImageURL{URL: tt.url}},
+			}}}
+			attachments, cleanup, err := imageAttachments(messages, tt.imageDir)
+			if tt.wantErr {
+				if err == nil {
+					cleanup()
+					t.Fatalf("expected error for %q", tt.url)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer cleanup()
+			if len(attachments) != 1 {
+				t.Fatalf("expected 1 attachment, got %d", len(attachments))
+			}
+		})
+	}
+}
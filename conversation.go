@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// sessionCache keeps Copilot sessions alive between the turns of a
+// conversation so follow-up requests only send their new messages. A
+// session is owned by at most one request at a time: take removes it from
+// the cache and put returns it once the turn has finished. A nil cache
+// disables reuse.
+type sessionCache struct {
+	mu         sync.Mutex
+	entries    map[string]*cachedSession
+	ttl        time.Duration
+	maxEntries int
+	done       chan struct{}
+}
+
+// cachedSession is an idle session together with the hash of the
+// conversation it holds
+type cachedSession struct {
+	session  *liveSession
+	prefix   string
+	lastUsed time.Time
+}
+
+// liveSession is a Copilot session that outlives a single request,
+// together with the bridge its tool handlers wait on and the tool calls
+// it is parked on, if any. client is the backend that created it; owner
+// and model identify it in the admin API.
+type liveSession struct {
+	session copilotSession
+	tools   *toolBridge
+	pending []string
+	client  copilotBackend
+	owner   string
+	model   string
+}
+
+// destroy releases any waiting tool handlers and destroys the session
+func (l *liveSession) destroy() {
+	l.tools.close()
+	l.session.Destroy()
+}
+
+// newSessionCache returns a cache that destroys sessions idle for longer
+// than ttl and holds at most maxEntries of them. A non-positive ttl or
+// maxEntries disables caching and returns nil.
+func newSessionCache(ttl time.Duration, maxEntries int) *sessionCache {
+	if ttl <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	c := &sessionCache{
+		entries:    make(map[string]*cachedSession),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		done:       make(chan struct{}),
+	}
+	go c.janitor()
+	return c
+}
+
+// janitor periodically evicts expired sessions until Close is called
+func (c *sessionCache) janitor() {
+	interval := c.ttl / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.evictExpired(time.Now())
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// take removes and returns the session stored under key if it holds the
+// conversation identified by prefix. A session stored under key for a
+// different conversation (e.g. an edited history behind an explicit
+// session ID) is stale and destroyed.
+func (c *sessionCache) take(key, prefix string) *liveSession {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if entry.prefix != prefix {
+		slog.Debug("Cached session no longer matches the conversation, destroying", "session_id", entry.session.session.ID())
+		entry.session.destroy()
+		return nil
+	}
+	return entry.session
+}
+
+// put stores an idle session under key, destroying any session it
+// replaces and the least recently used sessions beyond maxEntries.
+func (c *sessionCache) put(key, prefix string, session *liveSession) {
+	if c == nil {
+		session.destroy()
+		return
+	}
+	var evicted []*liveSession
+
+	c.mu.Lock()
+	if old, ok := c.entries[key]; ok && old.session != session {
+		evicted = append(evicted, old.session)
+	}
+	c.entries[key] = &cachedSession{session: session, prefix: prefix, lastUsed: time.Now()}
+	for len(c.entries) > c.maxEntries {
+		oldestKey := ""
+		var oldest time.Time
+		for k, e := range c.entries {
+			if oldestKey == "" || e.lastUsed.Before(oldest) {
+				oldestKey, oldest = k, e.lastUsed
+			}
+		}
+		evicted = append(evicted, c.entries[oldestKey].session)
+		delete(c.entries, oldestKey)
+	}
+	c.mu.Unlock()
+
+	for _, s := range evicted {
+		s.destroy()
+	}
+}
+
+// evictExpired destroys sessions that have been idle longer than the TTL
+func (c *sessionCache) evictExpired(now time.Time) {
+	var expired []*liveSession
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if now.Sub(entry.lastUsed) > c.ttl {
+			expired = append(expired, entry.session)
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(expired) > 0 {
+		slog.Debug("Evicting idle sessions", "count", len(expired))
+	}
+	for _, s := range expired {
+		s.destroy()
+	}
+}
+
+// Len returns the number of idle cached sessions
+func (c *sessionCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// sessionInfo describes a session for the admin API: an idle one kept
+// for reuse, or an active one serving a request
+type sessionInfo struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	RequestID string `json:"request_id,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	Model     string `json:"model"`
+	// PendingTools counts the tool calls an idle session is parked on
+	PendingTools int `json:"pending_tool_calls"`
+	// LastUsed is when an active session's request started
+	LastUsed time.Time `json:"last_used"`
+}
+
+// list describes every idle cached session, most recently used first
+func (c *sessionCache) list() []sessionInfo {
+	infos := []sessionInfo{}
+	if c == nil {
+		return infos
+	}
+	c.mu.Lock()
+	for _, entry := range c.entries {
+		infos = append(infos, sessionInfo{
+			ID:           entry.session.session.ID(),
+			State:        "idle",
+			Owner:        entry.session.owner,
+			Model:        entry.session.model,
+			PendingTools: len(entry.session.pending),
+			LastUsed:     entry.lastUsed,
+		})
+	}
+	c.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastUsed.After(infos[j].LastUsed) })
+	return infos
+}
+
+// remove destroys the cached sessions matching fn and returns how many
+// there were
+func (c *sessionCache) remove(fn func(*liveSession) bool) int {
+	if c == nil {
+		return 0
+	}
+	var removed []*liveSession
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if fn(entry.session) {
+			removed = append(removed, entry.session)
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+	for _, s := range removed {
+		s.destroy()
+	}
+	return len(removed)
+}
+
+// Close stops the janitor and destroys every cached session
+func (c *sessionCache) Close() {
+	if c == nil {
+		return
+	}
+	close(c.done)
+	c.mu.Lock()
+	entries := c.entries
+	c.entries = make(map[string]*cachedSession)
+	c.mu.Unlock()
+	for _, entry := range entries {
+		entry.session.destroy()
+	}
+}
+
+// conversationRequest describes a chat-style request in the form shared
+// by every API surface
+type conversationRequest struct {
+	// Owner is the fingerprint of the API key, so sessions are never
+	// shared between callers
+	Owner string
+	// SessionID is an explicit X-Session-Id supplied by the client
+	SessionID string
+	Model     string
+	Messages  []Message
+	// Tools are the tools the model may call, already narrowed by
+	// ToolChoice
+	Tools      []Tool
+	ToolChoice toolChoice
+	// Format is the requested JSON output format, or nil for text
+	Format *outputFormat
+	Stream bool
+}
+
+// sessionIDFromHeader returns the client's X-Session-Id, echoing it on
+// the response so clients can confirm the session was honored.
+func sessionIDFromHeader(w http.ResponseWriter, r *http.Request) string {
+	id := strings.TrimSpace(r.Header.Get("X-Session-Id"))
+	if id != "" {
+		w.Header().Set("X-Session-Id", id)
+	}
+	return id
+}
+
+// conversationErrorStatus maps an error returned by openConversation onto
+// an HTTP status code and a client-facing message.
+func conversationErrorStatus(err error) (int, string) {
+	if errors.Is(err, errCreateSession) {
+		return http.StatusInternalServerError, "Failed to create session"
+	}
+	return http.StatusBadRequest, err.Error()
+}
+
+// conversation is a session prepared for one turn of a conversation:
+// a session parked on tool calls that the request answers, a cached
+// session that already holds the earlier turns, or a new one that
+// receives the whole transcript.
+type conversation struct {
+	live    *liveSession
+	message copilot.MessageOptions
+	reused  bool
+	// toolResults answer the tool calls the session is parked on; they
+	// are delivered to its tool handlers instead of sending a prompt
+	toolResults []Message
+
+	cache   *sessionCache
+	req     conversationRequest
+	cleanup func()
+	kept    bool
+
+	// server records the session against the request it serves and,
+	// with client, starts a new one when the turn is retried
+	server *Server
+	client copilotBackend
+	retry  retryPolicy
+}
+
+// messageFingerprint is the part of a message that identifies it when a
+// client echoes the conversation back. Whitespace around content is
+// ignored since clients commonly trim it.
+type messageFingerprint struct {
+	Role       string   `json:"r"`
+	Content    string   `json:"c"`
+	Images     int      `json:"i,omitempty"`
+	ToolCalls  []string `json:"t,omitempty"`
+	ToolCallID string   `json:"id,omitempty"`
+}
+
+// conversationHash identifies a session by its owner, configuration and
+// the messages it has seen.
+func conversationHash(req conversationRequest, messages []Message) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode([]interface{}{req.Owner, req.Model, req.Stream})
+	enc.Encode(req.Tools)
+	for _, msg := range messages {
+		fp := messageFingerprint{
+			Role:       msg.Role,
+			Content:    strings.TrimSpace(msg.Content),
+			ToolCallID: msg.ToolCallID,
+		}
+		for _, part := range msg.Parts {
+			if part.Type == "image_url" {
+				fp.Images++
+			}
+		}
+		for _, tc := range msg.ToolCalls {
+			fp.ToolCalls = append(fp.ToolCalls, tc.ID+":"+tc.Function.Name)
+		}
+		enc.Encode(fp)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitConversation splits messages after the last assistant message.
+// The prefix is what a cached session would already hold; the tail is
+// what still has to be sent. ok is false when the tail cannot simply be
+// appended to an existing session.
+func splitConversation(messages []Message) (prefix, tail []Message, ok bool) {
+	last := -1
+	for i, msg := range messages {
+		if msg.Role == "assistant" {
+			last = i
+		}
+	}
+	if last < 0 || last == len(messages)-1 {
+		return nil, nil, false
+	}
+	tail = messages[last+1:]
+	for _, msg := range tail {
+		if msg.Role != "user" && msg.Role != "tool" {
+			return nil, nil, false
+		}
+	}
+	return messages[:last+1], tail, true
+}
+
+// tailPrompt builds the prompt for the new messages of a reused session.
+// A lone user message is sent as-is, since the session already carries
+// the turn structure.
+func tailPrompt(tail []Message) string {
+	if len(tail) == 1 && tail[0].Role == "user" {
+		return tail[0].Content
+	}
+	return buildPrompt(tail)
+}
+
+// openConversation prepares a session for req, reusing a cached session
+// when one holds the earlier turns. The caller must call close, and keep
+// once the turn has succeeded so the session can serve the next turn.
+func (s *Server) openConversation(ctx context.Context, client copilotBackend, req conversationRequest) (*conversation, error) {
+	conv := &conversation{cache: s.sessions, req: req, cleanup: func() {}, server: s, client: client, retry: s.config.Retry}
+
+	if prefix, tail, ok := splitConversation(req.Messages); ok {
+		// A follow-up answering a parked turn's tool calls resumes it
+		if ids := toolResultIDs(tail); len(ids) > 0 {
+			key := toolCallKey(req, ids)
+			if live := s.sessions.take(key, key); live != nil {
+				slog.DebugContext(ctx, "Resuming session with tool results", "session_id", live.session.ID(), "tool_results", len(ids))
+				conv.live = live
+				conv.reused = true
+				conv.toolResults = tail
+				return conv, nil
+			}
+		}
+
+		prefixKey := conversationHash(req, prefix)
+		key := sessionCacheKey(req, prefixKey)
+		if live := s.sessions.take(key, prefixKey); live != nil {
+			attachments, cleanup, err := imageAttachments(tail, s.config.ImageDir)
+			if err != nil {
+				s.sessions.put(key, prefixKey, live)
+				return nil, err
+			}
+			slog.DebugContext(ctx, "Reusing session", "session_id", live.session.ID(), "new_messages", len(tail))
+			conv.live = live
+			conv.reused = true
+			conv.cleanup = cleanup
+			conv.message = copilot.MessageOptions{Prompt: tailPrompt(tail), Attachments: attachments}
+			return conv, nil
+		}
+	}
+
+	live, message, cleanup, err := s.newSession(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	conv.live = live
+	conv.cleanup = cleanup
+	conv.message = message
+	return conv, nil
+}
+
+// newSession creates a session for req that is sent the whole transcript.
+// The caller must call cleanup once the message has been sent.
+func (s *Server) newSession(ctx context.Context, client copilotBackend, req conversationRequest) (*liveSession, copilot.MessageOptions, func(), error) {
+	attachments, cleanup, err := imageAttachments(req.Messages, s.config.ImageDir)
+	if err != nil {
+		return nil, copilot.MessageOptions{}, nil, err
+	}
+
+	cfg := sessionConfigFor(req.Model, req.Messages, req.Tools, req.Stream)
+	tools := newToolBridge()
+	tools.attach(cfg)
+	session, err := s.createSession(ctx, client, req.Model, cfg)
+	if err != nil {
+		cleanup()
+		slog.ErrorContext(ctx, "Creating session failed", "model", req.Model, "error", err)
+		return nil, copilot.MessageOptions{}, nil, fmt.Errorf("%w: %v", errCreateSession, err)
+	}
+	slog.DebugContext(ctx, "Session created", "session_id", session.ID(), "model", req.Model)
+
+	live := &liveSession{session: session, tools: tools, client: client, owner: req.Owner, model: req.Model}
+	return live, copilot.MessageOptions{Prompt: buildPrompt(req.Messages), Attachments: attachments}, cleanup, nil
+}
+
+// restart replaces the session with a new one that is sent the whole
+// transcript, for retrying the turn
+func (c *conversation) restart(ctx context.Context) error {
+	live, message, cleanup, err := c.server.newSession(ctx, c.client, c.req)
+	if err != nil {
+		return err
+	}
+	c.cleanup()
+	c.live.destroy()
+	c.live, c.message, c.cleanup = live, message, cleanup
+	c.reused, c.toolResults = false, nil
+	c.server.requests.attach(ctx, live.session, c.req.Model)
+	return nil
+}
+
+// sessionCacheKey returns the key a conversation's session is cached
+// under: the explicit session ID when the client supplied one, otherwise
+// the hash of the conversation the session holds.
+func sessionCacheKey(req conversationRequest, prefix string) string {
+	if req.SessionID == "" {
+		return prefix
+	}
+	sum := sha256.Sum256([]byte(req.Owner + "\x00" + req.SessionID))
+	return "id:" + hex.EncodeToString(sum[:])
+}
+
+// run runs the turn, enforcing a tool_choice that forces a tool call or
+// the requested output format, and retrying it on a new session after a
+// transient upstream error
+func (c *conversation) run(ctx context.Context, opts turnOptions) (*turnResult, error) {
+	c.server.requests.attach(ctx, c.live.session, c.req.Model)
+	ctx, span := startTurnSpan(ctx, "chat", c.req.Model, c.live.session.ID(), opts)
+	result, err := c.retry.run(ctx, opts, func(opts turnOptions) (*turnResult, error) {
+		switch {
+		case c.req.ToolChoice.forced():
+			return c.runForced(ctx, opts)
+		case c.req.Format != nil:
+			return c.runFormatted(ctx, opts)
+		default:
+			return c.runOnce(ctx, opts)
+		}
+	}, func() error { return c.restart(ctx) })
+	observeTurn(ctx, result, err)
+	endTurnSpan(span, result, err)
+	auditTurn(ctx, c.req, result, err)
+	return result, err
+}
+
+// runOnce runs the turn: delivering the tool results to a parked session,
+// or sending the prompt.
+func (c *conversation) runOnce(ctx context.Context, opts turnOptions) (*turnResult, error) {
+	// Usage is estimated from the conversation when the session reports
+	// none
+	if opts.Messages == nil {
+		opts.Messages = c.req.Messages
+	}
+	if c.toolResults != nil {
+		pending := c.live.pending
+		c.live.pending = nil
+		return runTurnWith(ctx, c.live.session, func() error {
+			c.live.tools.resolve(pending, c.toolResults)
+			return nil
+		}, opts)
+	}
+	return runTurn(ctx, c.live.session, c.message, opts)
+}
+
+// keep returns the session to the cache after a successful turn. A
+// completed turn is keyed by the conversation including the reply, which
+// is what the client will send back next time. A turn that ended in tool
+// calls is parked on their IDs, with its tool handlers waiting for the
+// client's results. A turn cut at a stop sequence or the token limit was
+// aborted, so that session is not reused.
+func (c *conversation) keep(result *turnResult) {
+	if c.cache == nil || result == nil || result.StopSequence != "" {
+		return
+	}
+	switch result.FinishReason {
+	case "stop":
+		held := append(append([]Message{}, c.req.Messages...), Message{Role: "assistant", Content: result.Content})
+		prefix := conversationHash(c.req, held)
+		c.cache.put(sessionCacheKey(c.req, prefix), prefix, c.live)
+	case "tool_calls":
+		ids := toolCallIDs(result.ToolCalls)
+		key := toolCallKey(c.req, ids)
+		c.live.pending = ids
+		slog.Debug("Parking session on tool calls", "session_id", c.live.session.ID(), "tool_calls", len(ids))
+		c.cache.put(key, key, c.live)
+	default:
+		return
+	}
+	c.kept = true
+}
+
+// close releases the request's resources and destroys the session unless
+// it was kept for the next turn.
+func (c *conversation) close() {
+	c.cleanup()
+	if !c.kept {
+		c.live.destroy()
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestSplitConversation(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []Message
+		prefix   int
+		tail     int
+		ok       bool
+	}{
+		{"first turn", []Message{{Role: "user", Content: "hi"}}, 0, 0, false},
+		{"follow-up", []Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", Content: "hello"},
+			{Role: "user", Content: "how are you?"},
+		}, 3, 1, true},
+		{"tool results", []Message{
+			{Role: "user", Content: "weather?"},
+			{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Function: ToolCallFunction{Name: "get_weather"}}}},
+			{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+		}, 2, 1, true},
+		{"ends with assistant", []Message{
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", Content: "hello"},
+		}, 0, 0, false},
+		{"system message in tail", []Message{
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", Content: "hello"},
+			{Role: "system", Content: "now be verbose"},
+			{Role: "user", Content: "again"},
+		}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, tail, ok := splitConversation(tt.messages)
+			if ok != tt.ok || len(prefix) != tt.prefix || len(tail) != tt.tail {
+				t.Errorf("got prefix=%d tail=%d ok=%v, want prefix=%d tail=%d ok=%v",
+					len(prefix), len(tail), ok, tt.prefix, tt.tail, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConversationHash(t *testing.T) {
+	req := conversationRequest{Owner: "owner", Model: "gpt-4"}
+	messages := []Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}}
+	base := conversationHash(req, messages)
+
+	// Clients often trim the echoed assistant reply
+	trimmed := []Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "\nhello \n"}}
+	if got := conversationHash(req, trimmed); got != base {
+		t.Error("expected surrounding whitespace to be ignored")
+	}
+
+	otherOwner := req
+	otherOwner.Owner = "someone-else"
+	if conversationHash(otherOwner, messages) == base {
+		t.Error("expected different owners to get different hashes")
+	}
+
+	otherModel := req
+	otherModel.Model = "claude-sonnet-4"
+	if conversationHash(otherModel, messages) == base {
+		t.Error("expected different models to get different hashes")
+	}
+
+	edited := []Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "goodbye"}}
+	if conversationHash(req, edited) == base {
+		t.Error("expected an edited history to get a different hash")
+	}
+}
+
+func TestSessionCacheKey(t *testing.T) {
+	req := conversationRequest{Owner: "owner"}
+	if got := sessionCacheKey(req, "abc"); got != "abc" {
+		t.Errorf("expected the prefix hash as key, got %q", got)
+	}
+
+	req.SessionID = "chat-1"
+	key := sessionCacheKey(req, "abc")
+	if key != sessionCacheKey(req, "def") {
+		t.Error("expected an explicit session ID to be independent of the conversation")
+	}
+	req.Owner = "someone-else"
+	if sessionCacheKey(req, "abc") == key {
+		t.Error("expected session IDs to be scoped to their owner")
+	}
+}
+
+func TestTailPrompt(t *testing.T) {
+	if got := tailPrompt([]Message{{Role: "user", Content: "next question"}}); got != "next question" {
+		t.Errorf("expected a lone user message to be sent as-is, got %q", got)
+	}
+
+	got := tailPrompt([]Message{{Role: "tool", ToolCallID: "call_1", Content: "sunny"}})
+	if got != "[Tool result for call_1]: sunny" {
+		t.Errorf("unexpected tool prompt %q", got)
+	}
+}
+
+func TestSessionCacheTakeAndPut(t *testing.T) {
+	cache := newSessionCache(time.Hour, 10)
+	defer cache.Close()
+
+	session := &liveSession{session: sdkSession{&copilot.Session{}}, tools: newToolBridge()}
+	cache.put("key", "prefix", session)
+	if cache.Len() != 1 {
+		t.Fatalf("expected 1 cached session, got %d", cache.Len())
+	}
+
+	if got := cache.take("other", "prefix"); got != nil {
+		t.Error("expected no session for an unknown key")
+	}
+	if got := cache.take("key", "prefix"); got != session {
+		t.Error("expected the cached session")
+	}
+	if cache.Len() != 0 {
+		t.Error("expected take to remove the session while it is in use")
+	}
+}
+
+func TestSessionCacheDisabled(t *testing.T) {
+	if cache := newSessionCache(0, 10); cache != nil {
+		t.Fatal("expected a zero TTL to disable the cache")
+	}
+
+	var cache *sessionCache
+	if got := cache.take("key", "prefix"); got != nil {
+		t.Error("expected a nil cache to never return a session")
+	}
+	if cache.Len() != 0 {
+		t.Error("expected a nil cache to be empty")
+	}
+}
+
+func TestConversationKeepMatchesNextTurn(t *testing.T) {
+	cache := newSessionCache(time.Hour, 10)
+	defer cache.Close()
+
+	session := &liveSession{session: sdkSession{&copilot.Session{}}, tools: newToolBridge()}
+	first := conversationRequest{
+		Owner:    "owner",
+		Model:    "gpt-4",
+		Messages: []Message{{Role: "user", Content: "hi"}},
+	}
+	conv := &conversation{live: session, cache: cache, req: first}
+	conv.keep(&turnResult{Content: "Hello!", FinishReason: "stop"})
+	if !conv.kept {
+		t.Fatal("expected a completed turn to be kept")
+	}
+
+	next := first
+	next.Messages = []Message{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "Hello!"},
+		{Role: "user", Content: "how are you?"},
+	}
+	prefix, _, ok := splitConversation(next.Messages)
+	if !ok {
+		t.Fatal("expected the follow-up to be splittable")
+	}
+	hash := conversationHash(next, prefix)
+	if got := cache.take(sessionCacheKey(next, hash), hash); got != session {
+		t.Error("expected the follow-up request to find the kept session")
+	}
+}
+
+func TestConversationKeepSkipsFailedTurns(t *testing.T) {
+	cache := newSessionCache(time.Hour, 10)
+	defer cache.Close()
+
+	req := conversationRequest{Messages: []Message{{Role: "user", Content: "hi"}}}
+	for _, result := range []*turnResult{
+		nil,
+		{FinishReason: "error"},
+		{FinishReason: "length"},
+		{FinishReason: "stop", StopSequence: "END"},
+	} {
+		conv := &conversation{live: &liveSession{session: sdkSession{&copilot.Session{}}, tools: newToolBridge()}, cache: cache, req: req}
+		conv.keep(result)
+		if conv.kept {
+			t.Errorf("expected %+v not to be kept", result)
+		}
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected no cached sessions, got %d", cache.Len())
+	}
+}
+
+func TestConversationKeepParksToolCalls(t *testing.T) {
+	cache := newSessionCache(time.Hour, 10)
+	defer cache.Close()
+
+	session := &liveSession{session: sdkSession{&copilot.Session{}}, tools: newToolBridge()}
+	conv := &conversation{live: session, cache: cache, req: conversationRequest{
+		Owner:    "owner",
+		Messages: []Message{{Role: "user", Content: "weather in Paris and Rome?"}},
+	}}
+	conv.keep(&turnResult{FinishReason: "tool_calls", ToolCalls: []ToolCall{
+		{ID: "call_1", Function: ToolCallFunction{Name: "get_weather"}},
+		{ID: "call_2", Function: ToolCallFunction{Name: "get_weather"}},
+	}})
+	if !conv.kept {
+		t.Fatal("expected the session to be parked")
+	}
+
+	// The results may come back in any order
+	key := toolCallKey(conversationRequest{Owner: "owner"}, []string{"call_2", "call_1"})
+	got := cache.take(key, key)
+	if got != session {
+		t.Fatal("expected the follow-up to find the parked session")
+	}
+	if len(got.pending) != 2 {
+		t.Errorf("expected 2 pending tool calls, got %v", got.pending)
+	}
+}
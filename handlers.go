@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
@@ -13,15 +14,72 @@ import (
 	"time"
 
 	copilot "github.com/github/copilot-sdk/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Config holds the server options set from the command line
+type Config struct {
+	// ImageDir is the directory clients may reference local image
+	// files from. Empty disables local image attachments.
+	ImageDir string
+	// SessionTTL is how long an idle conversation session is kept for
+	// reuse. Zero disables session reuse.
+	SessionTTL time.Duration
+	// MaxSessions bounds the number of idle sessions kept for reuse.
+	MaxSessions int
+	// KeysFile is the virtual key store. When set, clients must use a
+	// key issued by the server instead of a GitHub token.
+	KeysFile string
+	// AdminToken protects the admin API, which is disabled when empty.
+	AdminToken string
+	// MaxClients bounds the number of Copilot clients started for
+	// caller-supplied tokens, and ClientTTL stops clients idle for
+	// longer. Zero disables either limit.
+	MaxClients int
+	ClientTTL  time.Duration
+	// ClientHealthInterval is how often clients are expired and pinged.
+	// Zero disables health checks.
+	ClientHealthInterval time.Duration
+	// LogPrompts logs request and response bodies, which hold prompts
+	// and completions. Secrets in them are still redacted.
+	LogPrompts bool
+	// AuditFile enables the audit log of completion requests. It is
+	// rotated after AuditMaxSize bytes or AuditMaxAge, and AuditCapture
+	// adds full prompts and responses to it. AuditKeySecret keys the HMAC
+	// that identifies callers without a virtual key.
+	AuditFile      string
+	AuditMaxSize   int64
+	AuditMaxAge    time.Duration
+	AuditCapture   bool
+	AuditKeySecret string
+	// RecordDir records every turn of every Copilot session in this
+	// directory. ReplayDir plays recorded turns back instead of starting
+	// Copilot clients.
+	RecordDir string
+	ReplayDir string
+	// Retry retries turns that fail with a transient upstream error
+	Retry retryPolicy
+}
+
 // Server holds the copilot client(s) and configuration
-// Clients are keyed by the GitHub token; an optional default
+// Clients are keyed by a hash of the GitHub token; an optional default
 // client is created from the GH_TOKEN environment variable.
 type Server struct {
+	// backend, when set, serves every request instead of Copilot
+	// clients: the recordings of -replay, or a fake in tests
+	backend       copilotBackend
 	defaultClient *copilot.Client
-	clients       map[string]*copilot.Client
+	defaultToken  string
+	clients       *clientPool
 	mu            sync.Mutex
+	config        Config
+	responses     responseStore
+	sessions      *sessionCache
+	keys          *keyStore
+	audit         *auditLog
+	requests      requestTracker
+	done          chan struct{}
 }
 
 // NewServer creates a new server instance.  If the
@@ -29,12 +87,52 @@ type Server struct {
 // created with that token; otherwise the server starts with no
 // authenticated client and will reject requests until an api_key
 // is supplied by the caller.
-func NewServer() (*Server, error) {
+func NewServer(cfg Config) (*Server, error) {
+	if err := loadTokenizer(); err != nil {
+		return nil, err
+	}
+
 	srv := &Server{
-		clients: make(map[string]*copilot.Client),
+		clients: newClientPool(cfg.MaxClients, cfg.ClientTTL),
+		config:  cfg,
+		done:    make(chan struct{}),
+	}
+	// Cached sessions cannot outlive their client
+	srv.clients.onStop = func(client *copilot.Client) {
+		srv.sessions.remove(func(l *liveSession) bool { return l.client == (sdkBackend{client}) })
 	}
 
-	if gh := os.Getenv("GH_TOKEN"); gh != "" {
+	switch {
+	case cfg.RecordDir != "" && cfg.ReplayDir != "":
+		return nil, fmt.Errorf("recording and replaying cannot be combined")
+	case cfg.RecordDir != "":
+		if err := os.MkdirAll(cfg.RecordDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create recording directory: %w", err)
+		}
+	case cfg.ReplayDir != "":
+		if _, err := os.Stat(cfg.ReplayDir); err != nil {
+			return nil, fmt.Errorf("failed to open replay directory: %w", err)
+		}
+		srv.backend = replayBackend{dir: cfg.ReplayDir}
+	}
+
+	if cfg.KeysFile != "" {
+		keys, err := openKeyStore(cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.keys = keys
+	}
+
+	if cfg.AuditFile != "" {
+		audit, err := openAuditLog(cfg.AuditFile, cfg.AuditMaxSize, cfg.AuditMaxAge, cfg.AuditCapture, cfg.AuditKeySecret)
+		if err != nil {
+			return nil, err
+		}
+		srv.audit = audit
+	}
+
+	if gh := os.Getenv("GH_TOKEN"); gh != "" && cfg.ReplayDir == "" {
 		client := copilot.NewClient(&copilot.ClientOptions{
 			LogLevel: "error",
 			Env:      buildClientEnv(gh),
@@ -43,21 +141,32 @@ func NewServer() (*Server, error) {
 			return nil, fmt.Errorf("failed to start default copilot client: %w", err)
 		}
 		srv.defaultClient = client
+		srv.defaultToken = gh
+		// Learn the models for metrics labels without holding up startup
+		go sdkBackend{client}.ListModels()
 	}
 
+	srv.sessions = newSessionCache(cfg.SessionTTL, cfg.MaxSessions)
+	if cfg.ClientHealthInterval > 0 {
+		go srv.monitorClients(cfg.ClientHealthInterval, srv.done)
+	}
 	return srv, nil
 }
 
-// Close stops all copilot clients managed by the server
+// Close destroys cached sessions and stops all copilot clients managed
+// by the server
 func (s *Server) Close() {
+	close(s.done)
+	// Sessions belong to the clients, so destroy them first
+	s.sessions.Close()
+	s.clients.Close()
+	s.audit.Close()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.defaultClient != nil {
 		s.defaultClient.Stop()
 	}
-	for _, c := range s.clients {
-		c.Stop()
-	}
 }
 
 // getAPIKeyFromHeader returns the token supplied via
@@ -86,34 +195,41 @@ func extractAPIKey(r *http.Request, req *ChatCompletionRequest) string {
 	return ""
 }
 
-// getClient returns an active copilot client for the given
-// GitHub token.  A nil/empty token yields the default client if
-// available; otherwise an error is returned.  New clients are
-// temporarily created and cached.
-func (s *Server) getClient(token string) (*copilot.Client, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// tokenFingerprint returns a short, non-reversible identifier for a
+// token so ownership can be recorded without keeping the token itself.
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	return hashToken(token)[:16]
+}
 
+// getClient returns the backend for the given GitHub token: an
+// active copilot client, or the server's backend if it has one.  A
+// nil/empty token yields the default client if available; otherwise an
+// error is returned.  New clients are started and kept in the client
+// pool, which keeps them running until ctx is done.
+func (s *Server) getClient(ctx context.Context, token string) (copilotBackend, error) {
+	_, span := tracer().Start(ctx, "get_client", trace.WithAttributes(attribute.Bool("copilot.client.default", token == "")))
+	defer span.End()
+	if s.backend != nil {
+		return s.backend, nil
+	}
 	if token == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
 		if s.defaultClient != nil {
-			return s.defaultClient, nil
+			return sdkBackend{s.defaultClient}, nil
 		}
 		return nil, fmt.Errorf("no API key provided")
 	}
-
-	if client, ok := s.clients[token]; ok {
-		return client, nil
-	}
-
-	client := copilot.NewClient(&copilot.ClientOptions{
-		LogLevel: "error",
-		Env:      buildClientEnv(token),
-	})
-	if err := client.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start copilot client: %w", err)
+	client, release, err := s.clients.get(ctx, token)
+	if err != nil {
+		return nil, endSpan(span, err)
 	}
-	s.clients[token] = client
-	return client, nil
+	// The request uses the client until it is done
+	context.AfterFunc(ctx, release)
+	return sdkBackend{client}, nil
 }
 
 // buildClientEnv preserves the current process environment and injects
@@ -140,15 +256,16 @@ func (s *Server) HandleModels(w http.ResponseWriter, r *http.Request) {
 
 	// authentication
 	apiKey := getAPIKeyFromHeader(r)
-	client, err := s.getClient(apiKey)
+	client, err := s.clientFor(r.Context(), apiKey, "")
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "Missing or invalid API key", "authentication_error")
+		status, msg := authErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
 		return
 	}
 
 	models, err := client.ListModels()
 	if err != nil {
-		log.Printf("Error listing models: %v", err)
+		slog.ErrorContext(r.Context(), "Listing models failed", "error", err)
 		writeError(w, http.StatusInternalServerError, "Failed to list models", "api_error")
 		return
 	}
@@ -158,7 +275,11 @@ func (s *Server) HandleModels(w http.ResponseWriter, r *http.Request) {
 		Data:   make([]ModelData, 0, len(models)),
 	}
 
+	allowed := s.modelFilter(apiKey)
 	for _, model := range models {
+		if !allowed(model.ID) {
+			continue
+		}
 		response.Data = append(response.Data, ModelData{
 			ID:      model.ID,
 			Object:  "model",
@@ -178,18 +299,20 @@ func (s *Server) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req ChatCompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := decodeRequest(r, &req); err != nil {
 		writeError(w, http.StatusBadRequest, "Invalid request body", "invalid_request_error")
 		return
 	}
 
 	// enforce API key, either header or body
 	apiKey := extractAPIKey(r, &req)
-	client, err := s.getClient(apiKey)
+	client, err := s.clientFor(r.Context(), apiKey, req.Model)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "Missing or invalid API key", "authentication_error")
+		status, msg := authErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
 		return
 	}
+	labelRequest(r.Context(), req.Model, req.Stream)
 
 	if req.Model == "" {
 		writeError(w, http.StatusBadRequest, "Model is required", "invalid_request_error")
@@ -201,165 +324,116 @@ func (s *Server) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract system message - iterate through all messages to find system/developer roles
-	var systemMessageParts []string
-	for _, msg := range req.Messages {
-		if msg.Role == "system" || msg.Role == "developer" {
-			systemMessageParts = append(systemMessageParts, msg.Content)
-		}
-	}
-
-	// Build the prompt from messages (excluding system messages which are handled separately)
-	prompt := buildPrompt(req.Messages)
-
-	// Convert OpenAI tools to Copilot tools (definitions only, no handlers)
-	var copilotTools []copilot.Tool
-	log.Printf("[DEBUG] Received %d tools in request", len(req.Tools))
-	for _, tool := range req.Tools {
-		if tool.Type == "function" {
-			// toolJSON, _ := json.MarshalIndent(tool, "", "  ")
-			// log.Printf("[DEBUG] Tool %d: %s", i, string(toolJSON))
-			copilotTools = append(copilotTools, copilot.Tool{
-				Name:        tool.Function.Name,
-				Description: tool.Function.Description,
-				Parameters:  tool.Function.Parameters,
-				// No handler - we just want to capture tool calls
-			})
-		}
+	choice, err := parseToolChoice(req.ToolChoice)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
 	}
-
-	// Create session config
-	sessionConfig := &copilot.SessionConfig{
-		Model:     req.Model,
-		Streaming: req.Stream,
-		Tools:     copilotTools,
-		// Disable infinite sessions for simple request/response
-		InfiniteSessions: &copilot.InfiniteSessionConfig{
-			Enabled: copilot.Bool(false),
-		},
+	tools, err := choice.apply(req.Tools)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
 	}
-
-	// Add system message if present
-	if len(systemMessageParts) > 0 {
-		systemContent := strings.Join(systemMessageParts, "\n\n")
-		log.Printf("[DEBUG] Setting system message (length: %d)", len(systemContent))
-		sessionConfig.SystemMessage = &copilot.SystemMessageConfig{
-			Mode:    "replace",
-			Content: systemContent,
-		}
+	format, err := parseResponseFormat(req.ResponseFormat)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
 	}
-
-	// If tools are provided, we want to limit available tools to only our custom ones
-	// This prevents Copilot from using built-in file/git tools
-	if len(copilotTools) > 0 {
-		toolNames := make([]string, len(copilotTools))
-		for i, t := range copilotTools {
-			toolNames[i] = t.Name
-		}
-		sessionConfig.AvailableTools = toolNames
+	stops, err := parseStop(req.Stop)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
 	}
-
-	// Log session config
-	// log.Printf("[DEBUG] Creating session with model: %s, streaming: %v, tools: %d",
-	// 	req.Model, req.Stream, len(copilotTools))
-	for i, t := range copilotTools {
-		_ = i
-		_ = t
-		// paramsJSON, _ := json.Marshal(t.Parameters)
-		// log.Printf("[DEBUG] Copilot Tool %d: name=%s, desc=%s, params=%s",
-		// 	i, t.Name, t.Description, string(paramsJSON))
+	field, limit := "max_tokens", req.MaxTokens
+	if req.MaxCompletionTokens != nil {
+		field, limit = "max_completion_tokens", req.MaxCompletionTokens
 	}
-
-	// Create session
-	session, err := client.CreateSession(sessionConfig)
+	maxTokens, err := parseMaxTokens(field, limit)
 	if err != nil {
-		log.Printf("[ERROR] Creating session failed: %v", err)
-		writeError(w, http.StatusInternalServerError, "Failed to create session", "api_error")
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
 		return
 	}
-	defer session.Destroy()
-	log.Printf("[DEBUG] Session created successfully")
-
-	// Log the full prompt being sent
-	// log.Printf("[DEBUG] Full prompt being sent:\n%s", prompt)
-
-	if req.Stream {
-		log.Printf("[DEBUG] Starting streaming response")
-		s.handleStreamingResponse(w, session, prompt, req.Model)
-	} else {
-		log.Printf("[DEBUG] Starting non-streaming response")
-		s.handleNonStreamingResponse(w, session, prompt, req.Model)
+	opts := turnOptions{Stop: stops, MaxTokens: maxTokens}
+	messages := req.Messages
+	if format != nil {
+		messages = format.withInstructions(messages)
 	}
-}
 
-// handleNonStreamingResponse handles non-streaming chat completions
-func (s *Server) handleNonStreamingResponse(w http.ResponseWriter, session *copilot.Session, prompt, model string) {
-	var contentBuilder strings.Builder
-	var toolCalls []ToolCall
-	var finishReason string = "stop"
-	var sessionErrMessage string
-
-	done := make(chan bool)
-	var closeOnce sync.Once
-
-	session.On(func(event copilot.SessionEvent) {
-		switch event.Type {
-		case copilot.AssistantMessage:
-			// Check for tool requests
-			if len(event.Data.ToolRequests) > 0 {
-				finishReason = "tool_calls"
-				for _, tr := range event.Data.ToolRequests {
-					argsJSON, _ := json.Marshal(tr.Arguments)
-					toolCalls = append(toolCalls, ToolCall{
-						ID:   tr.ToolCallID,
-						Type: "function",
-						Function: ToolCallFunction{
-							Name:      tr.Name,
-							Arguments: string(argsJSON),
-						},
-					})
-				}
-			}
-			// Capture final content
-			if event.Data.Content != nil {
-				contentBuilder.WriteString(*event.Data.Content)
-			}
-
-		case copilot.SessionIdle:
-			closeOnce.Do(func() { close(done) })
+	n := 1
+	if req.N != nil {
+		n = *req.N
+	}
+	if n < 1 || n > maxCompletionChoices {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maxCompletionChoices), "invalid_request_error")
+		return
+	}
 
-		case copilot.SessionError:
-			if event.Data.Message != nil {
-				sessionErrMessage = *event.Data.Message
-				log.Printf("Session error: %s", sessionErrMessage)
-			}
-			closeOnce.Do(func() { close(done) })
+	// Reuse the session holding the earlier turns when there is one,
+	// otherwise start a new session with the whole transcript. Every
+	// choice runs in its own session; only the first one is bound to
+	// the client's session ID.
+	sessionID := sessionIDFromHeader(w, r)
+	convs := make([]*conversation, n)
+	errs := make([]error, n)
+	forEachChoice(n, func(i int) {
+		convReq := conversationRequest{
+			Owner:      tokenFingerprint(apiKey),
+			Model:      req.Model,
+			Messages:   messages,
+			Tools:      tools,
+			ToolChoice: choice,
+			Format:     format,
+			Stream:     req.Stream,
 		}
+		if i == 0 {
+			convReq.SessionID = sessionID
+		}
+		convs[i], errs[i] = s.openConversation(r.Context(), client, convReq)
 	})
-
-	// Send the message
-	_, err := session.Send(copilot.MessageOptions{
-		Prompt: prompt,
-	})
-	if err != nil {
-		log.Printf("Error sending message: %v", err)
-		writeError(w, http.StatusInternalServerError, "Failed to send message", "api_error")
-		return
+	defer func() {
+		for _, conv := range convs {
+			if conv != nil {
+				conv.close()
+			}
+		}
+	}()
+	for _, err := range errs {
+		if err != nil {
+			status, msg := conversationErrorStatus(err)
+			writeError(w, status, msg, openAIErrorTypeForStatus(status))
+			return
+		}
 	}
 
-	// Wait for completion with timeout
-	select {
-	case <-done:
-	case <-time.After(5 * time.Minute):
-		log.Printf("Request timed out")
-		writeError(w, http.StatusGatewayTimeout, "Request timed out", "api_error")
-		return
+	var results []*turnResult
+	if req.Stream {
+		slog.DebugContext(r.Context(), "Starting streaming response", "model", req.Model, "choices", n)
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		results = s.handleStreamingResponse(r.Context(), w, convs, req.Model, opts, includeUsage)
+	} else {
+		slog.DebugContext(r.Context(), "Starting non-streaming response", "model", req.Model, "choices", n)
+		results = s.handleNonStreamingResponse(r.Context(), w, convs, req.Model, opts)
 	}
+	for i, result := range results {
+		convs[i].keep(result)
+	}
+}
 
-	if sessionErrMessage != "" {
-		status := statusFromSessionError(sessionErrMessage)
-		writeError(w, status, userMessageFromSessionError(sessionErrMessage), openAIErrorTypeForStatus(status))
-		return
+// handleNonStreamingResponse handles non-streaming chat completions, one
+// choice per conversation, and returns the turn results, or nil if any
+// turn failed. opts carries the output limits.
+func (s *Server) handleNonStreamingResponse(ctx context.Context, w http.ResponseWriter, convs []*conversation, model string, opts turnOptions) []*turnResult {
+	results := make([]*turnResult, len(convs))
+	errs := make([]error, len(convs))
+	forEachChoice(len(convs), func(i int) {
+		results[i], errs[i] = convs[i].run(ctx, opts)
+	})
+	for _, err := range errs {
+		if err != nil {
+			status, msg := turnErrorStatus(err)
+			writeError(w, status, msg, openAIErrorTypeForStatus(status))
+			return nil
+		}
 	}
 
 	// Build response
@@ -368,37 +442,44 @@ func (s *Server) handleNonStreamingResponse(w http.ResponseWriter, session *copi
 		Object:  "chat.completion",
 		Created: currentTimestamp(),
 		Model:   model,
-		Choices: []Choice{
-			{
-				Index: 0,
-				Message: &Message{
-					Role:      "assistant",
-					Content:   contentBuilder.String(),
-					ToolCalls: toolCalls,
-				},
-				FinishReason: &finishReason,
+		Choices: make([]Choice, len(results)),
+	}
+	for i, result := range results {
+		response.Choices[i] = Choice{
+			Index: i,
+			Message: &Message{
+				Role:      "assistant",
+				Content:   result.Content,
+				ToolCalls: result.ToolCalls,
 			},
-		},
+			FinishReason: &result.FinishReason,
+		}
+		response.Usage = addUsage(response.Usage, result.Usage)
 	}
 
 	writeJSON(w, http.StatusOK, response)
+	return results
 }
 
-// handleStreamingResponse handles streaming chat completions with SSE
-func (s *Server) handleStreamingResponse(w http.ResponseWriter, session *copilot.Session, prompt, model string) {
+// handleStreamingResponse handles streaming chat completions with SSE,
+// interleaving the chunks of every choice and telling them apart by
+// index. It returns the turn results, with nil for failed choices. opts
+// carries the output limits; includeUsage adds a final usage chunk.
+func (s *Server) handleStreamingResponse(ctx context.Context, w http.ResponseWriter, convs []*conversation, model string, opts turnOptions, includeUsage bool) []*turnResult {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		writeError(w, http.StatusInternalServerError, "Streaming not supported", "api_error")
-		return
+		return nil
 	}
 
 	completionID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
-	done := make(chan bool)
-	var toolCalls []ToolCall
+
+	// Choices stream concurrently, so writes are serialized
 	var mu sync.Mutex
-	var sessionErrMessage string
 	headersSent := false
-	roleChunkSent := false
+	roleChunkSent := make([]bool, len(convs))
+	var firstErr error
+	var failed []int
 
 	ensureStreamingHeaders := func() {
 		if headersSent {
@@ -411,186 +492,150 @@ func (s *Server) handleStreamingResponse(w http.ResponseWriter, session *copilot
 		headersSent = true
 	}
 
-	ensureRoleChunk := func() {
-		if roleChunkSent {
-			return
-		}
-		ensureStreamingHeaders()
+	writeChunk := func(index int, delta Message, finishReason *string) {
 		chunk := ChatCompletionChunk{
 			ID:      completionID,
 			Object:  "chat.completion.chunk",
 			Created: currentTimestamp(),
 			Model:   model,
 			Choices: []Choice{{
-				Index:        0,
-				Delta:        &Message{Role: "assistant"},
-				FinishReason: nil,
+				Index:        index,
+				Delta:        &delta,
+				FinishReason: finishReason,
 			}},
 		}
 		data, _ := json.Marshal(chunk)
+		if finishReason != nil && s.config.LogPrompts {
+			slog.DebugContext(ctx, "Final SSE chunk", "finish_reason", *finishReason, "chunk", string(data))
+		}
 		fmt.Fprintf(w, "data: %s\n\n", data)
 		flusher.Flush()
-		roleChunkSent = true
 	}
 
-	sendChunk := func(delta Message, finishReason *string) {
-		ensureRoleChunk()
-		chunk := ChatCompletionChunk{
-			ID:      completionID,
-			Object:  "chat.completion.chunk",
-			Created: currentTimestamp(),
-			Model:   model,
-			Choices: []Choice{
-				{
-					Index:        0,
-					Delta:        &delta,
-					FinishReason: finishReason,
-				},
-			},
-		}
-		data, _ := json.Marshal(chunk)
-		if finishReason != nil {
-			log.Printf("[DEBUG] SSE chunk (finish=%s): %s", *finishReason, string(data))
+	// sendChunk writes a chunk for a choice, preceded by its role chunk.
+	// The caller holds mu.
+	sendChunk := func(index int, delta Message, finishReason *string) {
+		ensureStreamingHeaders()
+		if !roleChunkSent[index] {
+			writeChunk(index, Message{Role: "assistant"}, nil)
+			roleChunkSent[index] = true
 		}
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+		writeChunk(index, delta, finishReason)
 	}
 
-	var closeOnce sync.Once
-	session.On(func(event copilot.SessionEvent) {
-		// log.Printf("[DEBUG] Received event: %s", event.Type)
-		switch event.Type {
-		case copilot.AssistantMessageDelta:
-			// Stream content deltas
-			if event.Data.DeltaContent != nil {
-				sendChunk(Message{Content: *event.Data.DeltaContent}, nil)
-			}
+	results := make([]*turnResult, len(convs))
+	forEachChoice(len(convs), func(i int) {
+		send := func(delta Message, finishReason *string) {
+			mu.Lock()
+			defer mu.Unlock()
+			sendChunk(i, delta, finishReason)
+		}
 
-		case copilot.AssistantMessage:
-			log.Printf("[DEBUG] AssistantMessage - ToolRequests: %d, Content length: %d",
-				len(event.Data.ToolRequests),
-				func() int {
-					if event.Data.Content != nil {
-						return len(*event.Data.Content)
-					}
-					return 0
-				}())
-			// Check for tool requests
-			if len(event.Data.ToolRequests) > 0 {
-				log.Printf("[DEBUG] Tool calls found - streaming to client incrementally")
-				mu.Lock()
-				for i, tr := range event.Data.ToolRequests {
-					argsJSON, _ := json.Marshal(tr.Arguments)
-					// log.Printf("[DEBUG]   Tool %d: %s with args: %s", i, tr.Name, string(argsJSON))
-					idx := i
-					// Store for final chunk
-					toolCalls = append(toolCalls, ToolCall{
-						Index: &idx,
-						ID:    tr.ToolCallID,
-						Type:  "function",
-						Function: ToolCallFunction{
-							Name:      tr.Name,
-							Arguments: string(argsJSON),
-						},
-					})
-					// Stream tool call incrementally: first send id/type/name
-					sendChunk(Message{ToolCalls: []ToolCall{{
-						Index: &idx,
-						ID:    tr.ToolCallID,
-						Type:  "function",
-						Function: ToolCallFunction{
-							Name: tr.Name,
-						},
-					}}}, nil)
-					// Then send arguments
-					sendChunk(Message{ToolCalls: []ToolCall{{
-						Index: &idx,
-						Function: ToolCallFunction{
-							Arguments: string(argsJSON),
-						},
-					}}}, nil)
-				}
-				mu.Unlock()
-				// Return immediately - client needs to execute tools and send results back
-				closeOnce.Do(func() { close(done) })
+		result, err := convs[i].run(ctx, turnOptions{
+			Stop:      opts.Stop,
+			MaxTokens: opts.MaxTokens,
+			// Stream content deltas
+			OnDelta: func(delta string) {
+				send(Message{Content: delta}, nil)
+			},
+			OnToolCall: func(index int, call ToolCall) {
+				idx := index
+				// Stream tool call incrementally: first send id/type/name
+				send(Message{ToolCalls: []ToolCall{{
+					Index: &idx,
+					ID:    call.ID,
+					Type:  "function",
+					Function: ToolCallFunction{
+						Name: call.Function.Name,
+					},
+				}}}, nil)
+				// Then send arguments
+				send(Message{ToolCalls: []ToolCall{{
+					Index: &idx,
+					Function: ToolCallFunction{
+						Arguments: call.Function.Arguments,
+					},
+				}}}, nil)
+			},
+		})
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
 			}
-
-		case copilot.SessionIdle:
-			log.Printf("[DEBUG] SessionIdle - completing request")
-			closeOnce.Do(func() { close(done) })
-
-		case copilot.SessionError:
-			if event.Data.Message != nil {
-				sessionErrMessage = *event.Data.Message
-				log.Printf("[DEBUG] SessionError: %s", sessionErrMessage)
+			if headersSent {
+				sendChunk(i, Message{}, strPtr("error"))
+			} else {
+				failed = append(failed, i)
 			}
-			closeOnce.Do(func() { close(done) })
-
-		default:
-			// log.Printf("[DEBUG] Unhandled event type: %s", event.Type)
+			mu.Unlock()
+			return
 		}
-	})
 
-	// Send the message
-	_, err := session.Send(copilot.MessageOptions{
-		Prompt: prompt,
+		// Send final chunk with finish_reason. Tool calls were already
+		// streamed incrementally, so only the finish_reason is sent here.
+		send(Message{}, &result.FinishReason)
+		results[i] = result
 	})
-	if err != nil {
-		log.Printf("Error sending message: %v", err)
-		return
-	}
 
-	// Wait for completion
-	select {
-	case <-done:
-	case <-time.After(5 * time.Minute):
-		log.Printf("Streaming request timed out")
-		return
+	if !headersSent && firstErr != nil {
+		status, msg := turnErrorStatus(firstErr)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return results
+	}
+	// Choices that failed before anything was streamed still need a
+	// terminating chunk once other choices have started the stream
+	for _, i := range failed {
+		sendChunk(i, Message{}, strPtr("error"))
 	}
 
-	if sessionErrMessage != "" {
-		if !headersSent {
-			status := statusFromSessionError(sessionErrMessage)
-			writeError(w, status, userMessageFromSessionError(sessionErrMessage), openAIErrorTypeForStatus(status))
-			return
+	if includeUsage {
+		var usage *Usage
+		for _, result := range results {
+			if result != nil {
+				usage = addUsage(usage, result.Usage)
+			}
 		}
-		if !roleChunkSent {
-			ensureRoleChunk()
+		if usage == nil {
+			usage = &Usage{}
 		}
-		sendChunk(Message{}, strPtr("error"))
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		flusher.Flush()
-		return
-	}
-
-	// Send final chunk with finish_reason
-	mu.Lock()
-	if len(toolCalls) > 0 {
-		// log.Printf("[DEBUG] Tool calls already streamed, sending finish_reason only")
-		// Don't resend tool calls - they were already streamed incrementally
-		sendChunk(Message{}, strPtr("tool_calls"))
-	} else {
-		sendChunk(Message{}, strPtr("stop"))
+		data, _ := json.Marshal(ChatCompletionChunk{
+			ID:      completionID,
+			Object:  "chat.completion.chunk",
+			Created: currentTimestamp(),
+			Model:   model,
+			Choices: []Choice{},
+			Usage:   usage,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
 	}
-	mu.Unlock()
 
 	// Send [DONE]
-	// log.Printf("[DEBUG] Sending [DONE] marker")
 	fmt.Fprintf(w, "data: [DONE]\n\n")
 	flusher.Flush()
+	return results
 }
 
 var capiStatusCodePattern = regexp.MustCompile(`\b([1-5][0-9]{2})\b`)
 
-func statusFromSessionError(message string) int {
+// capiStatus returns the HTTP status of the CAPIError in a session error
+// message, if there is one
+func capiStatus(message string) (int, bool) {
 	if idx := strings.Index(message, "CAPIError:"); idx >= 0 {
 		segment := message[idx:]
 		if matches := capiStatusCodePattern.FindStringSubmatch(segment); len(matches) == 2 {
 			if code, err := strconv.Atoi(matches[1]); err == nil {
-				return code
+				return code, true
 			}
 		}
 	}
+	return 0, false
+}
+
+func statusFromSessionError(message string) int {
+	if code, ok := capiStatus(message); ok {
+		return code
+	}
 	if strings.Contains(strings.ToLower(message), "timeout") {
 		return http.StatusGatewayTimeout
 	}
@@ -5,8 +5,6 @@ import (
 	"os"
 	"strings"
 	"testing"
-
-	copilot "github.com/github/copilot-sdk/go"
 )
 
 func TestBuildPrompt(t *testing.T) {
@@ -151,7 +149,7 @@ func TestBuildClientEnv_PreservesBaseAndOverridesToken(t *testing.T) {
 }
 
 func TestHandleChatCompletions_NoAPIKey(t *testing.T) {
-	srv := &Server{clients: make(map[string]*copilot.Client)}
+	srv := &Server{clients: &clientPool{}}
 	// no default client
 	reqBody := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
 	req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(reqBody))
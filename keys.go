@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// virtualKeyPrefix marks the API keys issued by the server
+const virtualKeyPrefix = "sk-"
+
+// virtualKey is an API key issued by the server. Only a hash of the key
+// is stored; requests made with it use GitHubToken, or the server's
+// GH_TOKEN when that is empty.
+type virtualKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name,omitempty"`
+	Hash        string     `json:"hash"`
+	Hint        string     `json:"hint"`
+	GitHubToken string     `json:"github_token,omitempty"`
+	Models      []string   `json:"models,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// allows reports whether the key may use model. An empty allowlist
+// allows every model.
+func (k *virtualKey) allows(model string) bool {
+	if len(k.Models) == 0 || model == "" {
+		return true
+	}
+	for _, m := range k.Models {
+		if strings.EqualFold(m, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// authError is returned when a request's API key is rejected
+type authError struct {
+	Status  int
+	Message string
+}
+
+func (e *authError) Error() string {
+	return e.Message
+}
+
+var errInvalidKey = &authError{Status: http.StatusUnauthorized, Message: "Missing or invalid API key"}
+
+// authErrorStatus maps an error from clientFor onto an HTTP status code
+// and a client-facing message.
+func authErrorStatus(err error) (int, string) {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		return authErr.Status, authErr.Message
+	}
+	return http.StatusUnauthorized, "Missing or invalid API key"
+}
+
+// keyStore holds the virtual keys in a JSON file. The file is reloaded
+// when it changes, so keys created or revoked by another process take
+// effect without a restart.
+type keyStore struct {
+	mu     sync.Mutex
+	path   string
+	loaded os.FileInfo
+	keys   []*virtualKey
+	byHash map[string]*virtualKey
+}
+
+// openKeyStore loads the key store at path, creating an empty one if the
+// file does not exist yet.
+func openKeyStore(path string) (*keyStore, error) {
+	store := &keyStore{path: path, byHash: make(map[string]*virtualKey)}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// hashKey returns the stored form of a key
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// load reads the file unless it is unchanged since the last load. Saves
+// replace the file, so comparing the file itself catches changes made
+// within the resolution of the modification time. The caller holds mu,
+// except during openKeyStore.
+func (s *keyStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read key store: %w", err)
+	}
+	if s.loaded != nil && os.SameFile(s.loaded, info) && info.ModTime().Equal(s.loaded.ModTime()) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key store: %w", err)
+	}
+	var file struct {
+		Keys []*virtualKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse key store %s: %w", s.path, err)
+	}
+	s.keys = file.Keys
+	s.byHash = make(map[string]*virtualKey, len(file.Keys))
+	for _, key := range file.Keys {
+		s.byHash[key.Hash] = key
+	}
+	s.loaded = info
+	return nil
+}
+
+// save writes the keys atomically, readable by the owner only since the
+// file holds GitHub tokens. The caller holds mu.
+func (s *keyStore) save() error {
+	data, err := json.MarshalIndent(map[string]interface{}{"keys": s.keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".keys-*")
+	if err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.loaded = info
+	}
+	return nil
+}
+
+// lookup returns the key matching the one presented by a client, or an
+// authError if it is unknown, revoked or expired.
+func (s *keyStore) lookup(presented string) (*virtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	key, ok := s.byHash[hashKey(presented)]
+	switch {
+	case !ok:
+		return nil, errInvalidKey
+	case key.RevokedAt != nil:
+		return nil, &authError{Status: http.StatusUnauthorized, Message: "API key has been revoked"}
+	case key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt):
+		return nil, &authError{Status: http.StatusUnauthorized, Message: "API key has expired"}
+	}
+	return key, nil
+}
+
+// create issues a new key and returns it together with its record. The
+// key itself is not stored, so this is the only time it is available.
+func (s *keyStore) create(name, githubToken string, models []string, ttl time.Duration) (string, *virtualKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	plain := virtualKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	key := &virtualKey{
+		ID:          "key_" + hex.EncodeToString(id),
+		Name:        name,
+		Hash:        hashKey(plain),
+		Hint:        plain[:len(virtualKeyPrefix)+4] + "..." + plain[len(plain)-4:],
+		GitHubToken: githubToken,
+		Models:      models,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expires := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", nil, err
+	}
+	s.keys = append(s.keys, key)
+	s.byHash[key.Hash] = key
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	return plain, key, nil
+}
+
+// revoke marks the key with the given ID as revoked. It reports false if
+// there is no such key.
+func (s *keyStore) revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	for _, key := range s.keys {
+		if key.ID != id {
+			continue
+		}
+		if key.RevokedAt == nil {
+			now := time.Now().UTC()
+			key.RevokedAt = &now
+			if err := s.save(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// list returns a copy of every key, oldest first
+func (s *keyStore) list() ([]virtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	keys := make([]virtualKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// clientFor authenticates a client's API key and returns the Copilot
+// client to serve model with. With a key store configured only virtual
+// keys are accepted, are checked against their model allowlist (skipped
+// for an empty model) and are swapped for their GitHub token. Otherwise
+// the key is the GitHub token itself.
+func (s *Server) clientFor(ctx context.Context, apiKey, model string) (copilotBackend, error) {
+	s.requests.identify(ctx, apiKey)
+	auditKey(ctx, apiKey, "")
+	if s.keys == nil {
+		return s.getClient(ctx, apiKey)
+	}
+	if !strings.HasPrefix(apiKey, virtualKeyPrefix) {
+		return nil, errInvalidKey
+	}
+	key, err := s.keys.lookup(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	auditKey(ctx, apiKey, key.ID)
+	if !key.allows(model) {
+		return nil, &authError{Status: http.StatusForbidden, Message: fmt.Sprintf("API key is not allowed to use model '%s'", model)}
+	}
+	return s.getClient(ctx, key.GitHubToken)
+}
+
+// modelFilter returns a function that reports whether apiKey may use a
+// model, for filtering model lists. The key is looked up once, so a
+// long list doesn't hash it for every model. Keys that are not virtual
+// keys may use every model.
+func (s *Server) modelFilter(apiKey string) func(model string) bool {
+	if s.keys == nil {
+		return func(string) bool { return true }
+	}
+	key, err := s.keys.lookup(apiKey)
+	if err != nil {
+		return func(string) bool { return false }
+	}
+	return key.allows
+}
+
+// runKeysCommand implements the keys subcommand, which manages the key
+// store from the command line:
+//
+//	copilot-openai-server keys -keys-file keys.json create -name laptop -models gpt-4o -ttl 720h
+//	copilot-openai-server keys -keys-file keys.json list
+//	copilot-openai-server keys -keys-file keys.json revoke key_0123456789abcdef
+func runKeysCommand(args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	path := fs.String("keys-file", "keys.json", "Virtual API key store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: keys [-keys-file path] create|list|revoke")
+	}
+	store, err := openKeyStore(*path)
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "create":
+		cfs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		name := cfs.String("name", "", "Name to identify the key by")
+		token := cfs.String("github-token", "", "GitHub token to use for the key's requests (defaults to the server's GH_TOKEN). It is stored in plaintext in the key file")
+		models := cfs.String("models", "", "Comma-separated models the key may use (all when empty)")
+		ttl := cfs.Duration("ttl", 0, "How long the key is valid (forever when 0)")
+		if err := cfs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+		plain, key, err := store.create(*name, *token, splitList(*models), *ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created %s. The key is shown only once:\n%s\n", key.ID, plain)
+		return nil
+
+	case "list":
+		keys, err := store.list()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tKEY\tMODELS\tEXPIRES\tSTATUS")
+		for _, key := range keys {
+			expires := "never"
+			if key.ExpiresAt != nil {
+				expires = key.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Hint, strings.Join(key.Models, ","), expires, key.status(time.Now()))
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: keys [-keys-file path] revoke <id>")
+		}
+		found, err := store.revoke(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no key with id %s", fs.Arg(1))
+		}
+		fmt.Printf("Revoked %s\n", fs.Arg(1))
+		return nil
+	}
+	return fmt.Errorf("unknown keys command %q", fs.Arg(0))
+}
+
+// status describes whether the key can be used at the given time
+func (k *virtualKey) status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case k.ExpiresAt != nil && now.After(*k.ExpiresAt):
+		return "expired"
+	}
+	return "active"
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
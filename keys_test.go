@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := openKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, key, err := store.create("laptop", "ghp_backing", []string{"gpt-4o"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain) < 40 || plain[:3] != "sk-" {
+		t.Errorf("unexpected key format %q", plain)
+	}
+	if key.Hash == plain || key.Hash != hashKey(plain) {
+		t.Error("expected only the hash of the key to be stored")
+	}
+
+	// A second store sees keys written by the first
+	other, err := openKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := other.lookup(plain)
+	if err != nil || found.GitHubToken != "ghp_backing" {
+		t.Fatalf("lookup: %+v, %v", found, err)
+	}
+	if _, err := other.lookup("sk-unknown"); err == nil {
+		t.Error("expected an unknown key to be rejected")
+	}
+
+	if ok, err := other.revoke(key.ID); !ok || err != nil {
+		t.Fatalf("revoke: %v, %v", ok, err)
+	}
+	if _, err := store.lookup(plain); err == nil {
+		t.Error("expected a revoked key to be rejected")
+	}
+	if ok, _ := store.revoke("key_missing"); ok {
+		t.Error("expected revoking an unknown key to report false")
+	}
+}
+
+func TestKeyStoreExpiry(t *testing.T) {
+	store, err := openKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _, err := store.create("", "", nil, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	_, err = store.lookup(plain)
+	if status, msg := authErrorStatus(err); status != http.StatusUnauthorized || msg != "API key has expired" {
+		t.Errorf("got %d %q", status, msg)
+	}
+}
+
+func TestClientForVirtualKeys(t *testing.T) {
+	store, err := openKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _, err := store.create("ci", "", []string{"gpt-4o"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}, keys: store}
+
+	if client, err := srv.clientFor(context.Background(), plain, "gpt-4o"); err != nil || client != (sdkBackend{srv.defaultClient}) {
+		t.Errorf("expected the key to use the default client, got %v", err)
+	}
+	if _, err := srv.clientFor(context.Background(), plain, "claude-sonnet-4"); err == nil {
+		t.Error("expected a model outside the allowlist to be rejected")
+	} else if status, _ := authErrorStatus(err); status != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", status)
+	}
+	if _, err := srv.clientFor(context.Background(), "ghp_rawtoken", "gpt-4o"); err == nil {
+		t.Error("expected a raw GitHub token to be rejected when keys are required")
+	}
+	if _, err := srv.clientFor(context.Background(), "", "gpt-4o"); err == nil {
+		t.Error("expected the GH_TOKEN fallback to be disabled when keys are required")
+	}
+	if allowed := srv.modelFilter(plain); !allowed("gpt-4o") || allowed("o3") {
+		t.Error("expected model listing to follow the allowlist")
+	}
+}
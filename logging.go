@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader carries the request ID. OpenAI SDKs read it back as
+// x-request-id; header names are case-insensitive.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the incoming request IDs that are honored
+const maxRequestIDLength = 128
+
+// setupLogging makes a slog logger writing to w the default logger, and
+// routes the standard log package through it. format is "text" or
+// "json"; level is "debug", "info", "warn" or "error".
+func setupLogging(format, level string, w io.Writer) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q; use debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q; use text or json", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// contextHandler adds the request ID of the context to every record
+// logged with one of the slog ...Context functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID of the request ctx belongs to
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the caller's X-Request-Id if it is usable, or a new
+// random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+// validRequestID accepts short IDs of printable ASCII without spaces, so
+// a caller cannot inject fields or lines into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logOptions controls what loggingMiddleware logs
+type logOptions struct {
+	// Prompts enables logging of request and response bodies
+	Prompts bool
+	// Redact scrubs secrets from logged bodies and headers
+	Redact *redactor
+}
+
+// loggingMiddleware assigns every request an ID, echoed in the
+// X-Request-Id response header and added to everything logged for the
+// request, and logs the request once it has been served. Bodies hold
+// prompts and completions, so they are only logged when opts.Prompts is
+// set, and always with secrets redacted.
+func loggingMiddleware(next http.Handler, opts logOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		// The model and stream mode are filled in by the handler
+		m := &requestMetrics{endpoint: metricsEndpoint(r.URL.Path), start: start}
+		ctx := context.WithValue(context.WithValue(r.Context(), requestIDKey{}, id), requestMetricsKey{}, m)
+		r = r.WithContext(ctx)
+
+		// Read and log request body for POST requests
+		if opts.Prompts {
+			attrs := []any{"method", r.Method, "path", r.URL.Path, "headers", opts.Redact.Header(r.Header)}
+			if r.Method == http.MethodPost && r.Body != nil {
+				if bodyBytes, err := io.ReadAll(r.Body); err == nil {
+					attrs = append(attrs, "body", truncateBody(opts.Redact.Body(bodyBytes), 10000))
+					// Restore the body so it can be read again
+					r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+				}
+			}
+			slog.InfoContext(ctx, "Request received", attrs...)
+		} else {
+			slog.DebugContext(ctx, "Request received", "method", r.Method, "path", r.URL.Path)
+		}
+
+		// Wrap response writer to capture status and body
+		wrapped := newResponseWriter(w, opts.Prompts)
+		next.ServeHTTP(wrapped, r)
+
+		m.mu.Lock()
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", wrapped.statusCode,
+			"bytes", wrapped.size,
+			"duration_ms", time.Since(start).Milliseconds(),
+		}
+		if m.model != "" {
+			attrs = append(attrs, "model", m.model, "stream", m.stream)
+		}
+		if m.retries > 0 {
+			attrs = append(attrs, "retries", m.retries)
+		}
+		m.mu.Unlock()
+		// Log response body for non-streaming responses (limited size)
+		if wrapped.body != nil && wrapped.body.Len() > 0 && wrapped.body.Len() < 5000 {
+			attrs = append(attrs, "response_body", truncateBody(opts.Redact.Body(wrapped.body.Bytes()), 500))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case wrapped.statusCode >= 500:
+			level = slog.LevelError
+		case wrapped.statusCode >= 400:
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "Request served", attrs...)
+	})
+}
+
+// truncateBody truncates a body string to maxLen characters
+func truncateBody(body string, maxLen int) string {
+	if len(body) <= maxLen {
+		return body
+	}
+	return body[:maxLen] + "... (truncated)"
+}
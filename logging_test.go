@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger's JSON output to a buffer until
+// the test ends
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	var buf bytes.Buffer
+	if err := setupLogging("json", level, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	logs := captureLogs(t, "info")
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labelRequest(r.Context(), "gpt-4o", true)
+		slog.InfoContext(r.Context(), "Inside handler")
+		w.WriteHeader(http.StatusTeapot)
+	}), logOptions{Redact: newRedactor(nil)})
+
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"api_key":"ghp_secret"}`))
+	req.Header.Set("X-Request-Id", "client-id-1")
+	rw := &responseRecorder{head: http.Header{}}
+	handler.ServeHTTP(rw, req)
+
+	if got := rw.Header().Get("x-request-id"); got != "client-id-1" {
+		t.Errorf("expected the incoming request ID to be echoed, got %q", got)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two log lines, got %q", logs.String())
+	}
+	var served map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &served); err != nil {
+		t.Fatal(err)
+	}
+	if served["request_id"] != "client-id-1" || served["model"] != "gpt-4o" || served["stream"] != true ||
+		served["status"] != float64(http.StatusTeapot) || served["level"] != "WARN" {
+		t.Errorf("unexpected access log %v", served)
+	}
+	if !strings.Contains(lines[0], `"request_id":"client-id-1"`) {
+		t.Errorf("expected handler logs to carry the request ID, got %s", lines[0])
+	}
+	if strings.Contains(logs.String(), "ghp_secret") {
+		t.Error("expected the body not to be logged by default")
+	}
+}
+
+func TestLoggingMiddlewareGeneratesRequestIDs(t *testing.T) {
+	captureLogs(t, "error")
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), logOptions{Redact: newRedactor(nil)})
+
+	for _, incoming := range []string{"", "has spaces\nand a newline", strings.Repeat("x", maxRequestIDLength+1)} {
+		req, _ := http.NewRequest("GET", "/v1/models", nil)
+		if incoming != "" {
+			req.Header.Set("X-Request-Id", incoming)
+		}
+		rw := &responseRecorder{head: http.Header{}}
+		handler.ServeHTTP(rw, req)
+		if got := rw.Header().Get("X-Request-Id"); !strings.HasPrefix(got, "req_") {
+			t.Errorf("expected a generated request ID for %q, got %q", incoming, got)
+		}
+	}
+}
+
+func TestSetupLoggingRejectsInvalidOptions(t *testing.T) {
+	captureLogs(t, "info")
+	if err := setupLogging("xml", "info", &bytes.Buffer{}); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+	if err := setupLogging("json", "verbose", &bytes.Buffer{}); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+}
@@ -5,8 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,30 +16,81 @@ import (
 const version = "0.1.3"
 
 func main() {
+	// Manage virtual API keys instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeysCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	port := flag.Int("port", 8080, "Port to listen on")
+	imageDir := flag.String("image-dir", "", "Directory clients may attach local image files from (disabled when empty)")
+	sessionTTL := flag.Duration("session-ttl", 15*time.Minute, "How long idle conversation sessions are kept for reuse (0 disables reuse)")
+	maxSessions := flag.Int("max-sessions", 100, "Maximum number of idle conversation sessions kept for reuse")
+	keysFile := flag.String("keys-file", "", "Virtual API key store; when set, clients must use keys issued with the keys command")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the /admin API, which is disabled when empty (default $ADMIN_TOKEN)")
+	maxClients := flag.Int("max-clients", 50, "Maximum number of Copilot clients kept for caller-supplied GitHub tokens (0 is unbounded)")
+	clientTTL := flag.Duration("client-ttl", time.Hour, "How long a Copilot client for a caller-supplied token is kept while idle (0 keeps it)")
+	clientHealthInterval := flag.Duration("client-health-interval", time.Minute, "How often Copilot clients are health-checked and restarted if dead (0 disables)")
+	logPrompts := flag.Bool("log-prompts", false, "Log request and response bodies, which contain prompts and completions (secrets are still redacted)")
+	redactFields := flag.String("redact-fields", "", "Comma-separated extra JSON fields and headers to redact from logs")
+	traceExporter := flag.String("trace-exporter", defaultTraceExporter(), "OpenTelemetry trace exporter: otlp, stdout or none (default $OTEL_TRACES_EXPORTER, else none)")
+	auditFile := flag.String("audit-file", "", "Append an audit record of every completion request to this JSONL file (disabled when empty)")
+	auditMaxSize := flag.Int64("audit-max-size", 100, "Rotate the audit log once it reaches this many megabytes (0 disables)")
+	auditMaxAge := flag.Duration("audit-max-age", 24*time.Hour, "Rotate the audit log after this long (0 disables)")
+	auditCapture := flag.Bool("audit-capture", false, "Include full prompts and responses in the audit log")
+	auditKeySecret := flag.String("audit-key-secret", os.Getenv("AUDIT_KEY_SECRET"), "Secret for the HMAC that identifies API keys other than virtual keys in the audit log; they are not recorded when empty (default $AUDIT_KEY_SECRET)")
+	recordDir := flag.String("record", "", "Record every Copilot session turn in this directory, for -replay")
+	replayDir := flag.String("replay", "", "Serve the turns recorded with -record from this directory instead of Copilot")
+	retryAttempts := flag.Int("retry-attempts", 3, "Attempts per turn when Copilot fails with a transient error such as a 429 or 503 (1 disables retries)")
+	retryBaseDelay := flag.Duration("retry-base-delay", 500*time.Millisecond, "Backoff before the first retry, doubled for each further retry")
+	retryMaxDelay := flag.Duration("retry-max-delay", 30*time.Second, "Longest backoff between retries; longer retry-after hints fail the request")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
 	flag.Parse()
 
-	// Create server
-	server, err := NewServer()
-	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+	if err := setupLogging(*logFormat, *logLevel, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	// Setup routes
-	mux := http.NewServeMux()
-
-	// OpenAI-compatible endpoints
-	mux.HandleFunc("/v1/models", server.HandleModels)
-	mux.HandleFunc("/v1/chat/completions", server.HandleChatCompletions)
+	shutdownTracing, err := setupTracing(*traceExporter, os.Stdout)
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
 
-	// Health check
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+	// Create server
+	server, err := NewServer(Config{
+		ImageDir:             *imageDir,
+		SessionTTL:           *sessionTTL,
+		MaxSessions:          *maxSessions,
+		KeysFile:             *keysFile,
+		AdminToken:           *adminToken,
+		MaxClients:           *maxClients,
+		ClientTTL:            *clientTTL,
+		ClientHealthInterval: *clientHealthInterval,
+		LogPrompts:           *logPrompts,
+		AuditFile:            *auditFile,
+		AuditMaxSize:         *auditMaxSize << 20,
+		AuditMaxAge:          *auditMaxAge,
+		AuditCapture:         *auditCapture,
+		AuditKeySecret:       *auditKeySecret,
+		RecordDir:            *recordDir,
+		ReplayDir:            *replayDir,
+		Retry: retryPolicy{
+			Attempts:  *retryAttempts,
+			BaseDelay: *retryBaseDelay,
+			MaxDelay:  *retryMaxDelay,
+		},
 	})
+	if err != nil {
+		fatal("Failed to create server", "error", err)
+	}
 
-	// Middleware chain: logging -> CORS -> handlers
-	handler := loggingMiddleware(corsMiddleware(mux))
+	logOpts := logOptions{Prompts: *logPrompts, Redact: newRedactor(splitList(*redactFields))}
+	handler := server.Handler(logOpts)
 
 	// Start server
 	addr := fmt.Sprintf(":%d", *port)
@@ -55,7 +105,7 @@ func main() {
 
 	go func() {
 		<-sigChan
-		log.Println("Shutting down server...")
+		slog.Info("Shutting down server")
 
 		// Shutdown HTTP server with timeout
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -71,30 +121,112 @@ func main() {
 
 		select {
 		case <-done:
-			log.Println("Server stopped gracefully")
+			slog.Info("Server stopped gracefully")
 		case <-time.After(3 * time.Second):
-			log.Println("Timeout waiting for copilot client, forcing exit")
+			slog.Warn("Timeout waiting for copilot client, forcing exit")
+		}
+
+		// Flush spans that have not been exported yet. The HTTP shutdown
+		// may have used up its own deadline.
+		traceCtx, cancelTrace := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelTrace()
+		if err := shutdownTracing(traceCtx); err != nil {
+			slog.Error("Flushing traces failed", "error", err)
 		}
 
 		os.Exit(0)
 	}()
 
-	log.Printf("Starting OpenAI-compatible Copilot server v%s on http://localhost%s", version, addr)
-	log.Printf("Endpoints:")
-	log.Printf("  GET  /v1/models")
-	log.Printf("  POST /v1/chat/completions")
+	endpoints := []string{
+		"GET /v1/models",
+		"POST /v1/chat/completions",
+		"POST /v1/completions",
+		"POST /v1/responses",
+		"GET /v1/responses/{id}",
+		"POST /v1/messages",
+		"GET /api/tags",
+		"POST /api/chat",
+		"POST /api/generate",
+		"GET /metrics",
+	}
+	if *adminToken != "" {
+		endpoints = append(endpoints, "* /admin/{keys,clients,requests,sessions}")
+	}
+	slog.Info("Starting OpenAI-compatible Copilot server", "version", version, "url", "http://localhost"+addr, "endpoints", endpoints)
+	if *keysFile != "" {
+		slog.Info("Virtual API keys required", "key_store", *keysFile)
+	}
+	if *traceExporter != "none" && *traceExporter != "" {
+		slog.Info("Exporting traces", "exporter", *traceExporter)
+	}
+	if *auditFile != "" {
+		slog.Info("Writing audit log", "file", *auditFile, "capture", *auditCapture)
+	}
+	if *recordDir != "" {
+		slog.Warn("Recording Copilot sessions; recordings contain prompts and completions", "dir", *recordDir)
+	}
+	if *replayDir != "" {
+		slog.Info("Replaying recorded Copilot sessions", "dir", *replayDir)
+	}
+	if *logPrompts {
+		slog.Warn("Logging request and response bodies; they contain prompts and completions")
+	}
 
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+		fatal("Server error", "error", err)
 	}
 }
 
+// Handler returns the server's routes wrapped in its middleware
+func (s *Server) Handler(opts logOptions) http.Handler {
+	// Setup routes
+	mux := http.NewServeMux()
+
+	// OpenAI-compatible endpoints
+	mux.HandleFunc("/v1/models", s.HandleModels)
+	mux.HandleFunc("/v1/chat/completions", s.HandleChatCompletions)
+	mux.HandleFunc("/v1/completions", s.HandleCompletions)
+	mux.HandleFunc("/v1/responses", s.HandleResponses)
+	mux.HandleFunc("/v1/responses/", s.HandleResponse)
+
+	// Anthropic-compatible endpoints
+	mux.HandleFunc("/v1/messages", s.HandleMessages)
+
+	// Ollama-compatible endpoints
+	mux.HandleFunc("/api/tags", s.HandleOllamaTags)
+	mux.HandleFunc("/api/version", s.HandleOllamaVersion)
+	mux.HandleFunc("/api/chat", s.HandleOllamaChat)
+	mux.HandleFunc("/api/generate", s.HandleOllamaGenerate)
+
+	// Prometheus metrics
+	mux.Handle("/metrics", s.MetricsHandler())
+
+	// Admin API
+	mux.HandleFunc("/admin/", s.HandleAdmin)
+
+	// Health check
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	// Middleware chain: logging -> CORS -> tracing -> metrics -> audit -> request tracking -> handlers
+	return loggingMiddleware(corsMiddleware(TraceRequests(InstrumentRequests(s.AuditRequests(s.TrackRequests(mux))))), opts)
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 // corsMiddleware adds CORS headers for Open WebUI compatibility
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-version, X-Session-Id, X-Request-Id, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Session-Id, X-Request-Id")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -113,12 +245,17 @@ type responseWriter struct {
 	body       *bytes.Buffer
 }
 
-func newResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{
+// newResponseWriter wraps w, capturing the response body only if
+// captureBody is set
+func newResponseWriter(w http.ResponseWriter, captureBody bool) *responseWriter {
+	rw := &responseWriter{
 		ResponseWriter: w,
 		statusCode:     http.StatusOK,
-		body:           &bytes.Buffer{},
 	}
+	if captureBody {
+		rw.body = &bytes.Buffer{}
+	}
+	return rw
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -128,7 +265,9 @@ func (rw *responseWriter) WriteHeader(code int) {
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
 	rw.size += len(b)
-	rw.body.Write(b) // Capture response body
+	if rw.body != nil {
+		rw.body.Write(b) // Capture response body
+	}
 	return rw.ResponseWriter.Write(b)
 }
 
@@ -138,51 +277,3 @@ func (rw *responseWriter) Flush() {
 		flusher.Flush()
 	}
 }
-
-// loggingMiddleware logs request and response details
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Read and log request body for POST requests
-		var requestBody string
-		if r.Method == http.MethodPost && r.Body != nil {
-			bodyBytes, err := io.ReadAll(r.Body)
-			if err == nil {
-				requestBody = string(bodyBytes)
-				// Restore the body so it can be read again
-				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-			}
-		}
-
-		// Log incoming request
-		log.Printf("→ %s %s", r.Method, r.URL.Path)
-		if requestBody != "" {
-			log.Printf("  Request Body: %s", truncateBody(requestBody, 10000))
-		}
-
-		// Wrap response writer to capture status and body
-		wrapped := newResponseWriter(w)
-		next.ServeHTTP(wrapped, r)
-
-		duration := time.Since(start)
-
-		// Log response
-		log.Printf("← %s %s [%d] %d bytes in %v",
-			r.Method, r.URL.Path,
-			wrapped.statusCode, wrapped.size, duration)
-
-		// Log response body for non-streaming responses (limited size)
-		if wrapped.body.Len() > 0 && wrapped.body.Len() < 5000 {
-			log.Printf("  Response Body: %s", truncateBody(wrapped.body.String(), 500))
-		}
-	})
-}
-
-// truncateBody truncates a body string to maxLen characters
-func truncateBody(body string, maxLen int) string {
-	if len(body) <= maxLen {
-		return body
-	}
-	return body[:maxLen] + "... (truncated)"
-}
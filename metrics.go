@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics. Request metrics are labelled by endpoint, model,
+// status and stream mode; the model and stream mode are filled in by the
+// handlers through labelRequest once the caller has been authenticated.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "copilot_server_requests_total",
+		Help: "API requests served, by endpoint, model, status and stream mode.",
+	}, []string{"endpoint", "model", "status", "stream"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "copilot_server_request_duration_seconds",
+		Help:    "Time to serve API requests, by endpoint, model, status and stream mode.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"endpoint", "model", "status", "stream"})
+
+	timeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "copilot_server_time_to_first_token_seconds",
+		Help:    "Time from receiving a request to the first output from Copilot.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30, 60},
+	}, []string{"endpoint", "model"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "copilot_server_tokens_total",
+		Help: "Tokens consumed and generated, as reported by Copilot or estimated.",
+	}, []string{"endpoint", "model", "direction"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "copilot_server_upstream_errors_total",
+		Help: "Copilot session errors, by the status code parsed from the CAPIError.",
+	}, []string{"code"})
+
+	turnTimeoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "copilot_server_turn_timeouts_total",
+		Help: "Turns that did not finish before the turn timeout.",
+	})
+
+	turnCancellationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "copilot_server_turn_cancellations_total",
+		Help: "Turns aborted because the client disconnected or the request was cancelled.",
+	})
+
+	upstreamRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "copilot_server_upstream_retries_total",
+		Help: "Turns retried on a new session after a transient Copilot error.",
+	})
+
+	turnAttempts = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "copilot_server_turn_attempts",
+		Help:    "Attempts needed per turn, including retries.",
+		Buckets: []float64{1, 2, 3, 4, 5},
+	})
+)
+
+// metricsEndpoints are the routes that get their own endpoint label.
+// Anything else is counted as "other" so unknown paths cannot blow up
+// the number of series.
+var metricsEndpoints = map[string]bool{
+	"/v1/models":           true,
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/responses":        true,
+	"/v1/messages":         true,
+	"/api/tags":            true,
+	"/api/version":         true,
+	"/api/chat":            true,
+	"/api/generate":        true,
+}
+
+// metricsEndpoint returns the endpoint label for a request path
+func metricsEndpoint(path string) string {
+	switch {
+	case metricsEndpoints[path]:
+		return path
+	case strings.HasPrefix(path, "/v1/responses/"):
+		return "/v1/responses/{id}"
+	default:
+		return "other"
+	}
+}
+
+// metricsModels are the models Copilot has listed. The model of a request
+// is chosen by the caller, so only these get their own model label and
+// anything else is counted as "other".
+var metricsModels = struct {
+	sync.Mutex
+	known map[string]bool
+}{known: map[string]bool{}}
+
+// learnModels records models listed by Copilot as model labels
+func learnModels(models []copilot.ModelInfo) {
+	metricsModels.Lock()
+	defer metricsModels.Unlock()
+	for _, model := range models {
+		metricsModels.known[model.ID] = true
+	}
+}
+
+// metricsModel returns the model label for a requested model
+func metricsModel(model string) string {
+	if model == "" {
+		return ""
+	}
+	metricsModels.Lock()
+	defer metricsModels.Unlock()
+	if metricsModels.known[model] {
+		return model
+	}
+	return "other"
+}
+
+// requestMetrics collects the labels and timings of one request
+type requestMetrics struct {
+	mu         sync.Mutex
+	endpoint   string
+	model      string
+	stream     bool
+	start      time.Time
+	firstToken time.Time
+	retries    int
+}
+
+type requestMetricsKey struct{}
+
+// metricsFromContext returns the metrics of the request ctx belongs to,
+// or nil outside loggingMiddleware and InstrumentRequests
+func metricsFromContext(ctx context.Context) *requestMetrics {
+	m, _ := ctx.Value(requestMetricsKey{}).(*requestMetrics)
+	return m
+}
+
+// labelRequest records the model and stream mode of a request
+func labelRequest(ctx context.Context, model string, stream bool) {
+	if m := metricsFromContext(ctx); m != nil {
+		m.mu.Lock()
+		m.model, m.stream = model, stream
+		m.mu.Unlock()
+	}
+}
+
+// markFirstToken records when the first output of a request arrived. Only
+// the first call counts, across all choices of the request.
+func markFirstToken(ctx context.Context) {
+	if m := metricsFromContext(ctx); m != nil {
+		m.mu.Lock()
+		if m.firstToken.IsZero() {
+			m.firstToken = time.Now()
+		}
+		m.mu.Unlock()
+	}
+}
+
+// markRetry counts a retry of one of the request's turns
+func markRetry(ctx context.Context) {
+	upstreamRetriesTotal.Inc()
+	if m := metricsFromContext(ctx); m != nil {
+		m.mu.Lock()
+		m.retries++
+		m.mu.Unlock()
+	}
+}
+
+// observeTurn counts the tokens of a finished turn, or the reason it
+// failed
+func observeTurn(ctx context.Context, result *turnResult, err error) {
+	var sessErr *sessionError
+	switch {
+	case errors.Is(err, errTurnTimeout):
+		turnTimeoutsTotal.Inc()
+	case errors.Is(err, errClientGone):
+		turnCancellationsTotal.Inc()
+	case errors.As(err, &sessErr):
+		upstreamErrorsTotal.WithLabelValues(strconv.Itoa(statusFromSessionError(sessErr.Message))).Inc()
+	}
+	if result == nil || result.Usage == nil {
+		return
+	}
+	endpoint, model := "other", ""
+	if m := metricsFromContext(ctx); m != nil {
+		m.mu.Lock()
+		endpoint, model = m.endpoint, metricsModel(m.model)
+		m.mu.Unlock()
+	}
+	tokensTotal.WithLabelValues(endpoint, model, "input").Add(float64(result.Usage.PromptTokens))
+	tokensTotal.WithLabelValues(endpoint, model, "output").Add(float64(result.Usage.CompletionTokens))
+}
+
+// InstrumentRequests records request metrics for the API requests served
+// by next. It shares the labels loggingMiddleware put in the context, if
+// it runs inside it.
+func InstrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") && !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m := metricsFromContext(r.Context())
+		if m == nil {
+			m = &requestMetrics{endpoint: metricsEndpoint(r.URL.Path), start: time.Now()}
+			r = r.WithContext(context.WithValue(r.Context(), requestMetricsKey{}, m))
+		}
+		wrapped := newResponseWriter(w, false)
+		next.ServeHTTP(wrapped, r)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		model := metricsModel(m.model)
+		labels := []string{m.endpoint, model, strconv.Itoa(wrapped.statusCode), strconv.FormatBool(m.stream)}
+		requestsTotal.WithLabelValues(labels...).Inc()
+		requestDuration.WithLabelValues(labels...).Observe(time.Since(m.start).Seconds())
+		if !m.firstToken.IsZero() {
+			timeToFirstToken.WithLabelValues(m.endpoint, model).Observe(m.firstToken.Sub(m.start).Seconds())
+		}
+	})
+}
+
+// MetricsHandler serves the Prometheus metrics, including gauges of the
+// server's cached sessions and clients.
+func (s *Server) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal, requestDuration, timeToFirstToken, tokensTotal,
+		upstreamErrorsTotal, turnTimeoutsTotal, turnCancellationsTotal,
+		upstreamRetriesTotal, turnAttempts,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "copilot_server_idle_sessions",
+			Help: "Idle Copilot sessions kept for reuse.",
+		}, func() float64 { return float64(s.sessions.Len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "copilot_server_cached_clients",
+			Help: "Copilot clients started for caller-supplied GitHub tokens.",
+		}, func() float64 { return float64(s.clients.Len()) }),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
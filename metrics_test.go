@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func scrapeMetrics(t *testing.T, srv *Server) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rw := &responseRecorder{head: http.Header{}}
+	srv.MetricsHandler().ServeHTTP(rw, req)
+	return rw.body.String()
+}
+
+// metricValue returns the value of a series in scraped metrics, or 0 if
+// it is missing
+func metricValue(out, series string) float64 {
+	for _, line := range strings.Split(out, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, _ := strconv.ParseFloat(value, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestInstrumentRequests(t *testing.T) {
+	learnModels([]copilot.ModelInfo{{ID: "metrics-test-model"}})
+	serve := func(model string) {
+		handler := InstrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			labelRequest(r.Context(), model, true)
+			markFirstToken(r.Context())
+			observeTurn(r.Context(), &turnResult{Content: "hello", Usage: &Usage{PromptTokens: 7, CompletionTokens: 3}}, nil)
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", nil)
+		handler.ServeHTTP(&responseRecorder{head: http.Header{}}, req)
+	}
+
+	// Metrics are global, so compare against what earlier tests left
+	series := map[string]float64{
+		`copilot_server_requests_total{endpoint="/v1/chat/completions",model="metrics-test-model",status="418",stream="true"}`: 1,
+		`copilot_server_time_to_first_token_seconds_count{endpoint="/v1/chat/completions",model="metrics-test-model"}`:         1,
+		`copilot_server_tokens_total{direction="input",endpoint="/v1/chat/completions",model="metrics-test-model"}`:            7,
+		`copilot_server_tokens_total{direction="output",endpoint="/v1/chat/completions",model="metrics-test-model"}`:           3,
+		`copilot_server_requests_total{endpoint="/v1/chat/completions",model="other",status="418",stream="true"}`:              1,
+		`copilot_server_tokens_total{direction="input",endpoint="/v1/chat/completions",model="other"}`:                         7,
+	}
+	srv := &Server{clients: &clientPool{}, sessions: newSessionCache(0, 0)}
+	before := scrapeMetrics(t, srv)
+	serve("metrics-test-model")
+	serve("made-up-model-1234")
+	after := scrapeMetrics(t, srv)
+
+	for s, want := range series {
+		if got := metricValue(after, s) - metricValue(before, s); got != want {
+			t.Errorf("%s increased by %v, want %v", s, got, want)
+		}
+	}
+	for _, want := range []string{"copilot_server_cached_clients 0", "copilot_server_idle_sessions 0"} {
+		if !strings.Contains(after, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+	if strings.Contains(after, "made-up-model-1234") {
+		t.Error("expected an unlisted model not to get its own label")
+	}
+}
+
+func TestObserveTurnErrors(t *testing.T) {
+	ctx := context.Background()
+	observeTurn(ctx, nil, &sessionError{Message: "CAPIError: 429 rate limited"})
+	observeTurn(ctx, nil, errTurnTimeout)
+	observeTurn(ctx, nil, errClientGone)
+
+	out := scrapeMetrics(t, &Server{clients: &clientPool{}})
+	for _, want := range []string{
+		`copilot_server_upstream_errors_total{code="429"}`,
+		"copilot_server_turn_timeouts_total",
+		"copilot_server_turn_cancellations_total",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"/v1/chat/completions": "/v1/chat/completions",
+		"/v1/responses/resp_1": "/v1/responses/{id}",
+		"/v1/unknown/abc":      "other",
+	}
+	for path, want := range cases {
+		if got := metricsEndpoint(path); got != want {
+			t.Errorf("metricsEndpoint(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
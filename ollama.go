@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ollamaVersion is reported by /api/version. Clients use it to detect an
+// Ollama server and gate features, so it tracks a recent Ollama release
+// rather than this server's version.
+const ollamaVersion = "0.6.0"
+
+// writeOllamaError writes an Ollama-style error response
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, OllamaErrorResponse{Error: message})
+}
+
+// ollamaTimestamp formats a time the way Ollama reports created_at
+func ollamaTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ollamaImageParts converts Ollama's raw base64 images into image_url
+// content parts, sniffing the image type from the decoded bytes.
+func ollamaImageParts(images []string) ([]ContentPart, error) {
+	parts := make([]ContentPart, 0, len(images))
+	for _, image := range images {
+		data, err := base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 image data")
+		}
+		mimeType := http.DetectContentType(data)
+		parts = append(parts, ContentPart{
+			Type:     "image_url",
+			ImageURL: &ImageURL{URL: fmt.Sprintf("data:%s;base64,%s", mimeType, image)},
+		})
+	}
+	return parts, nil
+}
+
+// ollamaMessagesToMessages converts Ollama chat messages into chat
+// messages. Ollama tool calls carry no IDs, so tool results are matched
+// by tool name instead.
+func ollamaMessagesToMessages(messages []OllamaMessage) ([]Message, error) {
+	converted := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		out := Message{Role: msg.Role, Content: msg.Content}
+
+		if len(msg.Images) > 0 {
+			images, err := ollamaImageParts(msg.Images)
+			if err != nil {
+				return nil, err
+			}
+			out.Parts = append([]ContentPart{{Type: "text", Text: msg.Content}}, images...)
+		}
+
+		for _, tc := range msg.ToolCalls {
+			args := string(tc.Function.Arguments)
+			if args == "" {
+				args = "{}"
+			}
+			out.ToolCalls = append(out.ToolCalls, ToolCall{
+				ID:   tc.Function.Name,
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      tc.Function.Name,
+					Arguments: args,
+				},
+			})
+		}
+
+		if msg.Role == "tool" {
+			out.ToolCallID = msg.ToolName
+			if out.ToolCallID == "" {
+				out.ToolCallID = "tool"
+			}
+		}
+		converted = append(converted, out)
+	}
+	return converted, nil
+}
+
+// ollamaToolCalls converts tool calls into Ollama's form
+func ollamaToolCalls(calls []ToolCall) []OllamaToolCall {
+	converted := make([]OllamaToolCall, 0, len(calls))
+	for _, call := range calls {
+		converted = append(converted, OllamaToolCall{
+			Function: OllamaToolCallFunction{
+				Name:      call.Function.Name,
+				Arguments: toolInputJSON(call.Function.Arguments),
+			},
+		})
+	}
+	return converted
+}
+
+// ollamaTurnOptions extracts the turn options from Ollama model options.
+// A num_predict of zero or less means no limit, as in Ollama.
+func ollamaTurnOptions(options *OllamaOptions) turnOptions {
+	if options == nil {
+		return turnOptions{}
+	}
+	opts := turnOptions{Stop: options.Stop}
+	if options.NumPredict != nil && *options.NumPredict > 0 {
+		opts.MaxTokens = *options.NumPredict
+	}
+	return opts
+}
+
+// ollamaDoneReason maps a turn's finish reason onto Ollama's done_reason
+func ollamaDoneReason(result *turnResult) string {
+	if result.FinishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// HandleOllamaTags handles GET /api/tags
+func (s *Server) HandleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOllamaError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	client, err := s.clientFor(r.Context(), getAPIKeyFromHeader(r), "")
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		writeOllamaError(w, status, msg)
+		return
+	}
+
+	models, err := client.ListModels()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Listing models failed", "error", err)
+		writeOllamaError(w, http.StatusInternalServerError, "failed to list models")
+		return
+	}
+
+	now := ollamaTimestamp(time.Now())
+	response := OllamaTagsResponse{Models: make([]OllamaModel, 0, len(models))}
+	allowed := s.modelFilter(getAPIKeyFromHeader(r))
+	for _, model := range models {
+		if !allowed(model.ID) {
+			continue
+		}
+		digest := sha256.Sum256([]byte(model.ID))
+		response.Models = append(response.Models, OllamaModel{
+			Name:       model.ID,
+			Model:      model.ID,
+			ModifiedAt: now,
+			Digest:     hex.EncodeToString(digest[:]),
+			Details:    OllamaModelDetails{Format: "copilot", Family: "github-copilot"},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// HandleOllamaVersion handles GET /api/version
+func (s *Server) HandleOllamaVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"version": ollamaVersion})
+}
+
+// HandleOllamaChat handles POST /api/chat
+func (s *Server) HandleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOllamaError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req OllamaChatRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	client, err := s.clientFor(r.Context(), getAPIKeyFromHeader(r), req.Model)
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		writeOllamaError(w, status, msg)
+		return
+	}
+	labelRequest(r.Context(), req.Model, req.Stream == nil || *req.Stream)
+
+	if req.Model == "" {
+		writeOllamaError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeOllamaError(w, http.StatusBadRequest, "messages are required")
+		return
+	}
+
+	messages, err := ollamaMessagesToMessages(req.Messages)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Ollama streams unless told otherwise
+	stream := req.Stream == nil || *req.Stream
+	s.runOllama(r.Context(), w, client, ollamaRun{
+		owner:     tokenFingerprint(getAPIKeyFromHeader(r)),
+		sessionID: sessionIDFromHeader(w, r),
+		model:     req.Model,
+		messages:  messages,
+		tools:     req.Tools,
+		stream:    stream,
+		opts:      ollamaTurnOptions(req.Options),
+		chat:      true,
+	})
+}
+
+// HandleOllamaGenerate handles POST /api/generate
+func (s *Server) HandleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOllamaError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req OllamaGenerateRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	client, err := s.clientFor(r.Context(), getAPIKeyFromHeader(r), req.Model)
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		writeOllamaError(w, status, msg)
+		return
+	}
+	labelRequest(r.Context(), req.Model, req.Stream == nil || *req.Stream)
+
+	if req.Model == "" {
+		writeOllamaError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+
+	// An empty prompt is how Ollama clients preload a model; there is
+	// nothing to load here, so answer straight away.
+	if strings.TrimSpace(req.Prompt) == "" && len(req.Images) == 0 {
+		writeJSON(w, http.StatusOK, OllamaResponse{
+			Model:      req.Model,
+			CreatedAt:  ollamaTimestamp(time.Now()),
+			Response:   strPtr(""),
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	var messages []Message
+	if req.System != "" {
+		messages = append(messages, Message{Role: "system", Content: req.System})
+	}
+	user := Message{Role: "user", Content: req.Prompt}
+	if len(req.Images) > 0 {
+		images, err := ollamaImageParts(req.Images)
+		if err != nil {
+			writeOllamaError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		user.Parts = append([]ContentPart{{Type: "text", Text: req.Prompt}}, images...)
+	}
+	messages = append(messages, user)
+
+	stream := req.Stream == nil || *req.Stream
+	s.runOllama(r.Context(), w, client, ollamaRun{
+		owner:    tokenFingerprint(getAPIKeyFromHeader(r)),
+		model:    req.Model,
+		messages: messages,
+		stream:   stream,
+		opts:     ollamaTurnOptions(req.Options),
+	})
+}
+
+// ollamaRun describes a request to /api/chat or /api/generate once it has
+// been translated into chat messages
+type ollamaRun struct {
+	owner     string
+	sessionID string
+	model     string
+	messages  []Message
+	tools     []Tool
+	stream    bool
+	opts      turnOptions
+	// chat selects the /api/chat response shape (message) over the
+	// /api/generate one (response)
+	chat bool
+}
+
+// runOllama runs a translated Ollama request and writes either a single
+// JSON response or newline-delimited JSON chunks.
+func (s *Server) runOllama(ctx context.Context, w http.ResponseWriter, client copilotBackend, run ollamaRun) {
+	start := time.Now()
+
+	conv, err := s.openConversation(ctx, client, conversationRequest{
+		Owner:     run.owner,
+		SessionID: run.sessionID,
+		Model:     run.model,
+		Messages:  run.messages,
+		Tools:     run.tools,
+		Stream:    run.stream,
+	})
+	if err != nil {
+		status, msg := conversationErrorStatus(err)
+		writeOllamaError(w, status, msg)
+		return
+	}
+	defer conv.close()
+
+	// Generate requests are one-shot, so only chat sessions are worth
+	// keeping for a follow-up turn. Ollama tool results carry no call
+	// IDs and could never resume a session parked on its tool calls, so
+	// such a session is destroyed and the follow-up replays the results.
+	keep := func(result *turnResult) {
+		if run.chat && result.FinishReason != "tool_calls" {
+			conv.keep(result)
+		}
+	}
+
+	opts := run.opts
+	opts.Messages = run.messages
+
+	// chunk builds a response line carrying content and tool calls in the
+	// shape of the endpoint being served. The final line is built with
+	// the turn result.
+	chunk := func(content string, toolCalls []ToolCall, final *turnResult) OllamaResponse {
+		done := final != nil
+		resp := OllamaResponse{
+			Model:     run.model,
+			CreatedAt: ollamaTimestamp(time.Now()),
+			Done:      done,
+		}
+		if run.chat {
+			resp.Message = &OllamaMessage{Role: "assistant", Content: content}
+			if len(toolCalls) > 0 {
+				resp.Message.ToolCalls = ollamaToolCalls(toolCalls)
+			}
+		} else {
+			resp.Response = &content
+		}
+		if done {
+			resp.DoneReason = ollamaDoneReason(final)
+			resp.TotalDuration = time.Since(start).Nanoseconds()
+			resp.EvalDuration = resp.TotalDuration
+		}
+		return resp
+	}
+
+	if !run.stream {
+		result, err := conv.run(ctx, opts)
+		if err != nil {
+			status, msg := turnErrorStatus(err)
+			writeOllamaError(w, status, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, chunk(result.Content, result.ToolCalls, result))
+		keep(result)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOllamaError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	headersSent := false
+	writeLine := func(v interface{}) {
+		if !headersSent {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			headersSent = true
+		}
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "%s\n", data)
+		flusher.Flush()
+	}
+
+	streamedText := false
+	opts.OnDelta = func(delta string) {
+		streamedText = true
+		writeLine(chunk(delta, nil, nil))
+	}
+	opts.OnToolCall = func(index int, call ToolCall) {
+		writeLine(chunk("", []ToolCall{call}, nil))
+	}
+
+	result, err := conv.run(ctx, opts)
+	if err != nil {
+		status, msg := turnErrorStatus(err)
+		if !headersSent {
+			writeOllamaError(w, status, msg)
+			return
+		}
+		writeLine(OllamaErrorResponse{Error: msg})
+		return
+	}
+
+	// Models that do not stream deltas still deliver the final content
+	if !streamedText && result.Content != "" {
+		writeLine(chunk(result.Content, nil, nil))
+	}
+	writeLine(chunk("", nil, result))
+	keep(result)
+}
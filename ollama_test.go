@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestOllamaMessagesToMessages(t *testing.T) {
+	body := `[
+		{"role":"system","content":"Be terse."},
+		{"role":"user","content":"What is this?","images":["iVBORw0KGgoAAAANSUhEUg=="]},
+		{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}}]},
+		{"role":"tool","content":"sunny","tool_name":"get_weather"}
+	]`
+	var input []OllamaMessage
+	if err := json.Unmarshal([]byte(body), &input); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	messages, err := ollamaMessagesToMessages(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(messages))
+	}
+	if len(messages[1].Parts) != 2 || !strings.HasPrefix(messages[1].Parts[1].ImageURL.URL, "data:image/png;base64,") {
+		t.Errorf("expected PNG image part, got %+v", messages[1].Parts)
+	}
+	if calls := messages[2].ToolCalls; len(calls) != 1 || calls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected tool calls: %+v", calls)
+	}
+	if messages[3].ToolCallID != "get_weather" {
+		t.Errorf("expected tool result to be matched by name, got %q", messages[3].ToolCallID)
+	}
+
+	prompt := buildPrompt(messages)
+	if !strings.Contains(prompt, "[Tool result for get_weather]: sunny") {
+		t.Errorf("prompt missing tool result:\n%s", prompt)
+	}
+}
+
+func TestOllamaImageParts_InvalidBase64(t *testing.T) {
+	if _, err := ollamaImageParts([]string{"not base64!"}); err == nil {
+		t.Fatal("expected error for invalid base64")
+	}
+}
+
+func TestOllamaToolCalls(t *testing.T) {
+	calls := ollamaToolCalls([]ToolCall{{
+		ID:       "call_1",
+		Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+	}})
+	data, _ := json.Marshal(calls)
+	if string(data) != `[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}}]` {
+		t.Fatalf("unexpected tool calls JSON: %s", data)
+	}
+}
+
+func TestHandleOllamaGenerate_EmptyPromptLoadsModel(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	req, _ := http.NewRequest("POST", "/api/generate", strings.NewReader(`{"model":"gpt-4o"}`))
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleOllamaGenerate(rw, req)
+	if rw.status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rw.status)
+	}
+
+	var resp OllamaResponse
+	if err := json.Unmarshal([]byte(rw.body.String()), &resp); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+	if !resp.Done || resp.DoneReason != "load" || resp.Response == nil {
+		t.Fatalf("unexpected response: %s", rw.body.String())
+	}
+}
+
+func TestHandleOllamaChat_NoAPIKey(t *testing.T) {
+	srv := &Server{clients: &clientPool{}}
+	req, _ := http.NewRequest("POST", "/api/chat", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleOllamaChat(rw, req)
+	if rw.status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rw.status)
+	}
+	if !strings.Contains(rw.body.String(), `"error"`) {
+		t.Fatalf("expected Ollama error body, got %s", rw.body.String())
+	}
+}
+
+func TestOllamaTurnOptions(t *testing.T) {
+	two, zero := 2, 0
+	tests := []struct {
+		options *OllamaOptions
+		want    int
+	}{
+		{nil, 0},
+		{&OllamaOptions{}, 0},
+		{&OllamaOptions{NumPredict: &two}, 2},
+		{&OllamaOptions{NumPredict: &zero}, 0},
+	}
+	for _, tt := range tests {
+		if got := ollamaTurnOptions(tt.options).MaxTokens; got != tt.want {
+			t.Errorf("ollamaTurnOptions(%+v).MaxTokens = %d, want %d", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestOllamaDoneReason(t *testing.T) {
+	if got := ollamaDoneReason(&turnResult{FinishReason: "length"}); got != "length" {
+		t.Errorf("done_reason = %q, want length", got)
+	}
+	if got := ollamaDoneReason(&turnResult{FinishReason: "tool_calls"}); got != "stop" {
+		t.Errorf("done_reason = %q, want stop", got)
+	}
+}
+
+func TestHandleOllamaChat_ToolCallsAreNotParked(t *testing.T) {
+	call := copilot.ToolRequest{Name: "get_weather", ToolCallID: "call_1", Arguments: map[string]interface{}{"city": "Paris"}}
+	backend := newFakeBackend([]copilot.SessionEvent{messageEvent("", call)})
+	srv, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/api/chat", `{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"Weather?"}],"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]}`)
+	var chat OllamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chat); err != nil {
+		t.Fatal(err)
+	}
+	if chat.Message == nil || len(chat.Message.ToolCalls) != 1 {
+		t.Fatalf("response = %+v, want a tool call", chat)
+	}
+	// The follow-up cannot name the call, so nothing waits for it
+	if n := srv.sessions.Len(); n != 0 {
+		t.Errorf("%d sessions cached after an Ollama tool call, want 0", n)
+	}
+}
+
+func TestHandleOllamaChat_NumPredict(t *testing.T) {
+	backend := newFakeBackend([]copilot.SessionEvent{messageEvent("one two three four five six"), idleEvent()})
+	_, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/api/chat", `{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"Count"}],"options":{"num_predict":2}}`)
+	var chat OllamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chat); err != nil {
+		t.Fatal(err)
+	}
+	if chat.Message == nil || chat.Message.Content != "one two" || chat.DoneReason != "length" {
+		t.Errorf("response = %+v, want it cut off with done_reason length", chat)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// recordedTurn is one turn of a Copilot session, as written by -record
+// and played back by -replay: the events the session emitted after the
+// turn was started, until it went idle, failed, or the next turn
+// started. Each turn is stored in its own file named after its
+// fingerprint.
+type recordedTurn struct {
+	Fingerprint string                 `json:"fingerprint"`
+	Model       string                 `json:"model"`
+	Trigger     turnTrigger            `json:"trigger"`
+	Events      []copilot.SessionEvent `json:"events"`
+}
+
+// turnTrigger is what started a turn: a prompt sent to the session, or
+// the results of the tool calls the session was waiting on.
+type turnTrigger struct {
+	Prompt string `json:"prompt,omitempty"`
+	// Attachments are the SHA-256 of the attached files, since their
+	// paths are temporary
+	Attachments []string             `json:"attachments,omitempty"`
+	ToolResults []recordedToolResult `json:"tool_results,omitempty"`
+}
+
+// recordedToolResult is the result a tool handler returned to the session
+type recordedToolResult struct {
+	ToolCallID string `json:"tool_call_id"`
+	ResultType string `json:"result_type"`
+	Text       string `json:"text"`
+}
+
+// sessionFingerprint identifies a new session by the configuration that
+// shapes its output
+func sessionFingerprint(cfg *copilot.SessionConfig) string {
+	type tool struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	}
+	tools := make([]tool, len(cfg.Tools))
+	for i, t := range cfg.Tools {
+		tools[i] = tool{Name: t.Name, Description: t.Description, Parameters: t.Parameters}
+	}
+	system := ""
+	if cfg.SystemMessage != nil {
+		system = cfg.SystemMessage.Content
+	}
+	return fingerprint(cfg.Model, cfg.Streaming, system, tools, cfg.AvailableTools)
+}
+
+// turnFingerprint identifies a turn by the fingerprint of the session's
+// previous turn, or of the session itself for its first turn, and what
+// started it. A turn is therefore identified by everything the session
+// has been sent.
+func turnFingerprint(prev string, trigger turnTrigger) string {
+	results := append([]recordedToolResult{}, trigger.ToolResults...)
+	sort.Slice(results, func(i, j int) bool { return results[i].ToolCallID < results[j].ToolCallID })
+	trigger.ToolResults = results
+	return fingerprint(prev, trigger)
+}
+
+// fingerprint returns the hex SHA-256 of the JSON encoding of values
+func fingerprint(values ...interface{}) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, v := range values {
+		enc.Encode(v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// promptTrigger describes a prompt sent to a session
+func promptTrigger(message copilot.MessageOptions) turnTrigger {
+	trigger := turnTrigger{Prompt: message.Prompt}
+	for _, a := range message.Attachments {
+		id := a.DisplayName
+		if a.Path != "" {
+			if data, err := os.ReadFile(a.Path); err == nil {
+				sum := sha256.Sum256(data)
+				id = hex.EncodeToString(sum[:])
+			}
+		}
+		trigger.Attachments = append(trigger.Attachments, id)
+	}
+	return trigger
+}
+
+// toolRequests returns the tool calls requested by the assistant messages
+// of a turn
+func toolRequests(events []copilot.SessionEvent) []copilot.ToolRequest {
+	var requests []copilot.ToolRequest
+	for _, event := range events {
+		if event.Type == copilot.AssistantMessage {
+			requests = append(requests, event.Data.ToolRequests...)
+		}
+	}
+	return requests
+}
+
+// turnPath returns the file a turn is recorded in
+func turnPath(dir, fingerprint string) string {
+	return filepath.Join(dir, fingerprint+".json")
+}
+
+// writeTurn records a turn in dir. Turns hold prompts and completions,
+// so only the owner may read them.
+func writeTurn(dir string, turn *recordedTurn) error {
+	data, err := json.MarshalIndent(turn, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(turnPath(dir, turn.Fingerprint), data, 0o600)
+}
+
+// loadTurn reads the turn recorded under fingerprint
+func loadTurn(dir, fingerprint string) (*recordedTurn, error) {
+	data, err := os.ReadFile(turnPath(dir, fingerprint))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no recorded turn for fingerprint %s", fingerprint)
+		}
+		return nil, err
+	}
+	var turn recordedTurn
+	if err := json.Unmarshal(data, &turn); err != nil {
+		return nil, fmt.Errorf("invalid recorded turn %s: %w", fingerprint, err)
+	}
+	return &turn, nil
+}
+
+// recordedModels lists the models of the turns recorded in dir, which is
+// what -replay offers instead of asking Copilot
+func recordedModels(dir string) ([]copilot.ModelInfo, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	models := []copilot.ModelInfo{}
+	for _, path := range paths {
+		turn, err := loadTurn(dir, strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if turn.Model != "" && !seen[turn.Model] {
+			seen[turn.Model] = true
+			models = append(models, copilot.ModelInfo{ID: turn.Model, Name: turn.Model})
+		}
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models, nil
+}
+
+// replayBackend serves the turns recorded in dir
+type replayBackend struct {
+	dir string
+}
+
+func (b replayBackend) CreateSession(cfg *copilot.SessionConfig) (copilotSession, error) {
+	return newReplaySession(b.dir, cfg), nil
+}
+
+// ListModels lists the models of the recorded turns
+func (b replayBackend) ListModels() ([]copilot.ModelInfo, error) {
+	models, err := recordedModels(b.dir)
+	if err == nil {
+		learnModels(models)
+	}
+	return models, err
+}
+
+// recordingSession records the turns of an SDK session in dir. Its tool
+// handlers are wrapped so the results the client sends back are recorded
+// as the trigger of the turn that follows them.
+type recordingSession struct {
+	copilotSession
+	dir   string
+	model string
+
+	mu sync.Mutex
+	// fingerprint is that of the last recorded turn, or of the session
+	// before its first turn
+	fingerprint string
+	turn        *recordedTurn
+	// requested are the tool calls of the current turn, and awaiting the
+	// number of their results a tool result turn still expects
+	requested   []string
+	awaiting    int
+	unsubscribe func()
+}
+
+// newRecordingSession prepares the recording of a session created with
+// cfg, wrapping its tool handlers. wrap must be called with the session
+// once it has been created.
+func newRecordingSession(dir string, cfg *copilot.SessionConfig) *recordingSession {
+	r := &recordingSession{dir: dir, model: cfg.Model, fingerprint: sessionFingerprint(cfg)}
+	for i := range cfg.Tools {
+		handler := cfg.Tools[i].Handler
+		if handler == nil {
+			continue
+		}
+		cfg.Tools[i].Handler = func(invocation copilot.ToolInvocation) (copilot.ToolResult, error) {
+			result, err := handler(invocation)
+			r.toolResult(invocation.ToolCallID, result)
+			return result, err
+		}
+	}
+	return r
+}
+
+// wrap starts recording session
+func (r *recordingSession) wrap(session copilotSession) copilotSession {
+	r.copilotSession = session
+	r.unsubscribe = session.On(r.event)
+	return r
+}
+
+func (r *recordingSession) event(event copilot.SessionEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.turn == nil {
+		return
+	}
+	r.turn.Events = append(r.turn.Events, event)
+	switch event.Type {
+	case copilot.AssistantMessage:
+		for _, tr := range event.Data.ToolRequests {
+			r.requested = append(r.requested, tr.ToolCallID)
+		}
+	case copilot.SessionIdle, copilot.SessionError:
+		r.flush()
+	}
+}
+
+// Send starts a turn triggered by message
+func (r *recordingSession) Send(message copilot.MessageOptions) (string, error) {
+	r.mu.Lock()
+	r.start(promptTrigger(message))
+	r.mu.Unlock()
+	return r.copilotSession.Send(message)
+}
+
+// toolResult records the result of a tool call. The first result after a
+// turn requested tools starts the turn that continues from them.
+func (r *recordingSession) toolResult(toolCallID string, result copilot.ToolResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.awaiting <= 0 {
+		requested := len(r.requested)
+		r.start(turnTrigger{})
+		r.awaiting = requested
+	}
+	r.turn.Trigger.ToolResults = append(r.turn.Trigger.ToolResults, recordedToolResult{
+		ToolCallID: toolCallID,
+		ResultType: result.ResultType,
+		Text:       result.TextResultForLLM,
+	})
+	r.awaiting--
+}
+
+// start writes the current turn, if any, and starts a new one. The caller
+// must hold r.mu.
+func (r *recordingSession) start(trigger turnTrigger) {
+	r.flush()
+	r.turn = &recordedTurn{Model: r.model, Trigger: trigger}
+	r.requested = nil
+	r.awaiting = 0
+}
+
+// flush writes the current turn. The caller must hold r.mu.
+func (r *recordingSession) flush() {
+	if r.turn == nil {
+		return
+	}
+	r.fingerprint = turnFingerprint(r.fingerprint, r.turn.Trigger)
+	r.turn.Fingerprint = r.fingerprint
+	if len(r.turn.Events) == 0 {
+		// Nothing to play back, e.g. tool calls abandoned when the
+		// session was destroyed
+		r.turn = nil
+		return
+	}
+	if err := writeTurn(r.dir, r.turn); err != nil {
+		slog.Error("Writing recorded turn failed", "session_id", r.ID(), "fingerprint", r.fingerprint, "error", err)
+	} else {
+		slog.Debug("Recorded turn", "session_id", r.ID(), "fingerprint", r.fingerprint, "events", len(r.turn.Events))
+	}
+	r.turn = nil
+}
+
+// Destroy writes the unfinished turn, if any, and destroys the session
+func (r *recordingSession) Destroy() error {
+	r.unsubscribe()
+	r.mu.Lock()
+	r.flush()
+	r.mu.Unlock()
+	return r.copilotSession.Destroy()
+}
+
+// replaySessions numbers replayed sessions
+var replaySessions atomic.Int64
+
+// replaySession plays back the turns recorded in dir instead of talking
+// to Copilot. Like the CLI, it calls the session's tool handlers for the
+// tool calls of a turn and continues with the turn recorded for their
+// results.
+type replaySession struct {
+	id    string
+	dir   string
+	tools map[string]copilot.ToolHandler
+
+	mu          sync.Mutex
+	fingerprint string
+	handlers    []replayHandler
+	nextHandler int
+	// generation is bumped by Abort and Destroy to stop playback
+	generation int
+}
+
+type replayHandler struct {
+	id int
+	fn copilot.SessionEventHandler
+}
+
+// newReplaySession returns a session that replays the turns recorded for
+// sessions created with cfg
+func newReplaySession(dir string, cfg *copilot.SessionConfig) *replaySession {
+	s := &replaySession{
+		id:          fmt.Sprintf("replay-%d", replaySessions.Add(1)),
+		dir:         dir,
+		tools:       make(map[string]copilot.ToolHandler),
+		fingerprint: sessionFingerprint(cfg),
+	}
+	for _, tool := range cfg.Tools {
+		s.tools[tool.Name] = tool.Handler
+	}
+	return s
+}
+
+func (s *replaySession) ID() string {
+	return s.id
+}
+
+func (s *replaySession) On(handler copilot.SessionEventHandler) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextHandler
+	s.nextHandler++
+	s.handlers = append(s.handlers, replayHandler{id: id, fn: handler})
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, h := range s.handlers {
+			if h.id == id {
+				s.handlers = append(s.handlers[:i:i], s.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Send plays back the turn recorded for message. It fails if there is
+// none, as a live session fails to send when Copilot is unreachable.
+func (s *replaySession) Send(message copilot.MessageOptions) (string, error) {
+	s.mu.Lock()
+	fingerprint := turnFingerprint(s.fingerprint, promptTrigger(message))
+	s.mu.Unlock()
+	turn, err := loadTurn(s.dir, fingerprint)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.fingerprint = fingerprint
+	generation := s.generation
+	s.mu.Unlock()
+	go s.play(generation, turn)
+	return fingerprint, nil
+}
+
+// play emits the events of turn, then runs its tool calls and plays the
+// turn recorded for their results
+func (s *replaySession) play(generation int, turn *recordedTurn) {
+	for turn != nil {
+		for _, event := range turn.Events {
+			if !s.emit(generation, event) {
+				return
+			}
+		}
+		requests := toolRequests(turn.Events)
+		if len(requests) == 0 {
+			return
+		}
+
+		results := make([]recordedToolResult, len(requests))
+		var wg sync.WaitGroup
+		for i, tr := range requests {
+			wg.Add(1)
+			go func(i int, tr copilot.ToolRequest) {
+				defer wg.Done()
+				results[i] = s.callTool(tr)
+			}(i, tr)
+		}
+		wg.Wait()
+
+		s.mu.Lock()
+		if generation != s.generation {
+			s.mu.Unlock()
+			return
+		}
+		fingerprint := turnFingerprint(s.fingerprint, turnTrigger{ToolResults: results})
+		s.fingerprint = fingerprint
+		s.mu.Unlock()
+
+		var err error
+		if turn, err = loadTurn(s.dir, fingerprint); err != nil {
+			message := err.Error()
+			s.emit(generation, copilot.SessionEvent{Type: copilot.SessionError, Data: copilot.Data{Message: &message}})
+			return
+		}
+	}
+}
+
+// callTool runs the handler of a recorded tool call
+func (s *replaySession) callTool(tr copilot.ToolRequest) recordedToolResult {
+	result := copilot.ToolResult{ResultType: "failure", TextResultForLLM: fmt.Sprintf("Tool '%s' does not exist.", tr.Name)}
+	if handler := s.tools[tr.Name]; handler != nil {
+		var err error
+		result, err = handler(copilot.ToolInvocation{SessionID: s.id, ToolCallID: tr.ToolCallID, ToolName: tr.Name, Arguments: tr.Arguments})
+		if err != nil {
+			result = copilot.ToolResult{ResultType: "failure", TextResultForLLM: err.Error(), Error: err.Error()}
+		}
+	}
+	return recordedToolResult{ToolCallID: tr.ToolCallID, ResultType: result.ResultType, Text: result.TextResultForLLM}
+}
+
+// emit delivers an event to the handlers, unless playback of generation
+// has been stopped
+func (s *replaySession) emit(generation int, event copilot.SessionEvent) bool {
+	s.mu.Lock()
+	if generation != s.generation {
+		s.mu.Unlock()
+		return false
+	}
+	handlers := append([]replayHandler{}, s.handlers...)
+	s.mu.Unlock()
+	for _, h := range handlers {
+		h.fn(event)
+	}
+	return true
+}
+
+// Abort stops the playback of the current turn
+func (s *replaySession) Abort() error {
+	s.mu.Lock()
+	s.generation++
+	s.mu.Unlock()
+	return nil
+}
+
+// Destroy stops playback
+func (s *replaySession) Destroy() error {
+	return s.Abort()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// record runs one turn of a recorded scripted session for messages, as
+// HandleChatCompletions would
+func record(t *testing.T, dir, model string, messages []Message, stream bool, script []copilot.SessionEvent) {
+	t.Helper()
+	cfg := sessionConfigFor(model, messages, nil, stream)
+	session := newRecordingSession(dir, cfg).wrap(newFakeBackend(script).session(cfg))
+	if _, err := runTurn(context.Background(), session, copilot.MessageOptions{Prompt: buildPrompt(messages)}, turnOptions{}); err != nil {
+		t.Fatalf("recording turn: %v", err)
+	}
+	session.Destroy()
+}
+
+func TestReplayChatCompletion(t *testing.T) {
+	dir := t.TempDir()
+	messages := []Message{{Role: "user", Content: "Say hi"}}
+	record(t, dir, "gpt-4o", messages, false, []copilot.SessionEvent{messageEvent("Hi there"), idleEvent()})
+	record(t, dir, "gpt-4o", messages, true, []copilot.SessionEvent{deltaEvent("Hi "), deltaEvent("there"), messageEvent("Hi there"), idleEvent()})
+
+	srv := &Server{clients: &clientPool{}, backend: replayBackend{dir: dir}}
+	post := func(body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		srv.HandleChatCompletions(rw, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+		return rw
+	}
+
+	rw := post(`{"model":"gpt-4o","messages":[{"role":"user","content":"Say hi"}]}`)
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("non-streaming: status %d, body %s", rw.Code, rw.Body)
+	}
+	if got := resp.Choices[0].Message.Content; got != "Hi there" {
+		t.Errorf("non-streaming content = %v, want Hi there", got)
+	}
+
+	rw = post(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Say hi"}]}`)
+	if body := rw.Body.String(); !strings.Contains(body, `"content":"Hi "`) || !strings.Contains(body, "data: [DONE]") {
+		t.Errorf("streaming body = %s", body)
+	}
+
+	// A prompt that was never recorded fails instead of reaching Copilot
+	rw = post(`{"model":"gpt-4o","messages":[{"role":"user","content":"Say bye"}]}`)
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("unrecorded prompt: status %d, want 500", rw.Code)
+	}
+
+	models, err := recordedModels(dir)
+	if err != nil || len(models) != 1 || models[0].ID != "gpt-4o" {
+		t.Errorf("recordedModels = %v, %v", models, err)
+	}
+}
+
+func TestReplayToolCalls(t *testing.T) {
+	dir := t.TempDir()
+	tools := []Tool{{Type: "function", Function: ToolFunction{Name: "lookup", Parameters: map[string]interface{}{"type": "object"}}}}
+	messages := []Message{{Role: "user", Content: "Weather?"}}
+	call := copilot.ToolRequest{Name: "lookup", ToolCallID: "call_1", Arguments: map[string]interface{}{"city": "Paris"}}
+	results := []Message{{Role: "tool", ToolCallID: "call_1", Content: "Sunny"}}
+
+	// turn runs the tool call round trip on session, answering with results
+	turn := func(session copilotSession, bridge *toolBridge) (*turnResult, *turnResult) {
+		first, err := runTurn(context.Background(), session, copilot.MessageOptions{Prompt: buildPrompt(messages)}, turnOptions{})
+		if err != nil {
+			t.Fatalf("first turn: %v", err)
+		}
+		second, err := runTurnWith(context.Background(), session, func() error {
+			bridge.resolve(toolCallIDs(first.ToolCalls), results)
+			return nil
+		}, turnOptions{})
+		if err != nil {
+			t.Fatalf("second turn: %v", err)
+		}
+		return first, second
+	}
+
+	cfg := sessionConfigFor("gpt-4o", messages, tools, false)
+	bridge := newToolBridge()
+	bridge.attach(cfg)
+	recorder := newRecordingSession(dir, cfg)
+	session := recorder.wrap(newFakeBackend(
+		[]copilot.SessionEvent{messageEvent("", call)},
+		[]copilot.SessionEvent{messageEvent("It is sunny in Paris"), idleEvent()},
+	).session(cfg))
+	turn(session, bridge)
+	session.Destroy()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 2 {
+		t.Fatalf("recorded %d turns, want 2", len(files))
+	}
+
+	cfg = sessionConfigFor("gpt-4o", messages, tools, false)
+	bridge = newToolBridge()
+	bridge.attach(cfg)
+	replay := newReplaySession(dir, cfg)
+	first, second := turn(replay, bridge)
+	replay.Destroy()
+	if first.FinishReason != "tool_calls" || len(first.ToolCalls) != 1 || first.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("first turn = %+v", first)
+	}
+	if second.Content != "It is sunny in Paris" {
+		t.Errorf("second turn content = %q", second.Content)
+	}
+
+	// A different tool result was never recorded, so the session fails
+	bridge = newToolBridge()
+	cfg = sessionConfigFor("gpt-4o", messages, tools, false)
+	bridge.attach(cfg)
+	replay = newReplaySession(dir, cfg)
+	defer replay.Destroy()
+	results = []Message{{Role: "tool", ToolCallID: "call_1", Content: "Rainy"}}
+	first, err := runTurn(context.Background(), replay, copilot.MessageOptions{Prompt: buildPrompt(messages)}, turnOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runTurnWith(context.Background(), replay, func() error {
+		bridge.resolve(toolCallIDs(first.ToolCalls), results)
+		return nil
+	}, turnOptions{})
+	if _, ok := err.(*sessionError); !ok || !strings.Contains(err.Error(), "no recorded turn") {
+		t.Errorf("unrecorded tool result: err = %v", err)
+	}
+}
+
+func TestNewServerRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewServer(Config{RecordDir: dir, ReplayDir: dir}); err == nil {
+		t.Error("expected recording and replaying together to fail")
+	}
+	if _, err := NewServer(Config{ReplayDir: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected a missing replay directory to fail")
+	}
+
+	t.Setenv("GH_TOKEN", "ghp_test")
+	srv, err := NewServer(Config{ReplayDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if srv.defaultClient != nil {
+		t.Error("replaying should not start a Copilot client")
+	}
+	if client, err := srv.getClient(context.Background(), "ghp_other"); client != (replayBackend{dir: dir}) || err != nil {
+		t.Errorf("getClient = %v, %v; want the recordings", client, err)
+	}
+
+	record := filepath.Join(dir, "record")
+	srv, err = NewServer(Config{RecordDir: record})
+	if err == nil {
+		defer srv.Close()
+	}
+	if info, err := os.Stat(record); err != nil || !info.IsDir() {
+		t.Errorf("record directory not created: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tokenHashKey keys the HMAC that turns GitHub tokens into cache keys and
+// fingerprints. It is random per process, so a leaked fingerprint or
+// memory dump cannot be used to confirm a guessed token offline.
+var tokenHashKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate token hash key: %v", err))
+	}
+	return key
+}()
+
+// hashToken returns the keyed HMAC-SHA256 of a token, hex encoded
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, tokenHashKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// redactedValue replaces secrets in logged bodies and headers
+const redactedValue = "[REDACTED]"
+
+// defaultRedactFields are the JSON fields and headers that are always
+// scrubbed from logs, compared case-insensitively.
+var defaultRedactFields = []string{
+	"api_key", "apikey", "authorization", "x-api-key", "proxy-authorization", "cookie",
+	"github_token", "access_token", "refresh_token", "token", "password", "secret", "key",
+}
+
+// redactor scrubs secrets from request and response bodies and headers
+// before they are logged.
+type redactor struct {
+	fields map[string]bool
+}
+
+// newRedactor returns a redactor for the default fields plus extra
+func newRedactor(extra []string) *redactor {
+	r := &redactor{fields: make(map[string]bool)}
+	for _, field := range append(append([]string{}, defaultRedactFields...), extra...) {
+		if field = strings.TrimSpace(field); field != "" {
+			r.fields[strings.ToLower(field)] = true
+		}
+	}
+	return r
+}
+
+// Body returns a JSON body with the values of redacted fields replaced,
+// at any depth. Bodies that are not JSON are not logged, since secrets in
+// them cannot be found reliably.
+func (r *redactor) Body(body []byte) string {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Sprintf("(%d bytes, not JSON)", len(body))
+	}
+	scrubbed, err := json.Marshal(r.scrub(value))
+	if err != nil {
+		return fmt.Sprintf("(%d bytes)", len(body))
+	}
+	return string(scrubbed)
+}
+
+func (r *redactor) scrub(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if r.fields[strings.ToLower(name)] {
+				v[name] = redactedValue
+			} else {
+				v[name] = r.scrub(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = r.scrub(v[i])
+		}
+	}
+	return value
+}
+
+// Header returns a copy of h with the values of redacted headers replaced
+func (r *redactor) Header(h http.Header) http.Header {
+	scrubbed := h.Clone()
+	for name := range scrubbed {
+		if r.fields[strings.ToLower(name)] {
+			scrubbed[name] = []string{redactedValue}
+		}
+	}
+	return scrubbed
+}
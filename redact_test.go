@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestRedactorBody(t *testing.T) {
+	r := newRedactor([]string{"session_secret"})
+	got := r.Body([]byte(`{"model":"gpt-4o","api_key":"ghp_abc","metadata":{"Session_Secret":"s1","items":[{"token":"t1"}]}}`))
+	for _, secret := range []string{"ghp_abc", "s1", "t1"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("expected %q to be redacted from %s", secret, got)
+		}
+	}
+	if !strings.Contains(got, "gpt-4o") {
+		t.Errorf("expected other fields to be kept, got %s", got)
+	}
+
+	if got := r.Body([]byte("api_key=ghp_abc")); strings.Contains(got, "ghp_abc") {
+		t.Errorf("expected a body that is not JSON not to be logged, got %s", got)
+	}
+}
+
+func TestRedactorHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer ghp_abc")
+	h.Set("X-Api-Key", "sk-abc")
+	h.Set("Content-Type", "application/json")
+
+	got := newRedactor(nil).Header(h)
+	if got.Get("Authorization") != redactedValue || got.Get("X-Api-Key") != redactedValue {
+		t.Errorf("expected credentials to be redacted, got %v", got)
+	}
+	if got.Get("Content-Type") != "application/json" || h.Get("Authorization") != "Bearer ghp_abc" {
+		t.Error("expected other headers to be kept and the original to be untouched")
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	if hashToken("ghp_abc") != hashToken("ghp_abc") || hashToken("ghp_abc") == hashToken("ghp_abd") {
+		t.Error("expected hashes to be stable and distinct")
+	}
+	if strings.Contains(hashToken("ghp_abc"), "ghp_abc") || strings.HasPrefix(tokenFingerprint("ghp_abc"), "ghp") {
+		t.Error("expected hashes not to contain the token")
+	}
+
+	pool := &clientPool{start: func(string) (*copilot.Client, error) { return &copilot.Client{}, nil }}
+	use(pool, "ghp_abc")
+	for key := range pool.entries {
+		if key == "ghp_abc" {
+			t.Error("expected the pool not to be keyed by the raw token")
+		}
+	}
+}
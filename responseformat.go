@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	copilot "github.com/github/copilot-sdk/go"
+	"github.com/google/jsonschema-go/jsonschema"
+)
+
+// maxFormatRetries is how many times the model is asked to correct output
+// that does not match the requested response_format.
+const maxFormatRetries = 2
+
+// outputFormat is a parsed json_object or json_schema response_format
+type outputFormat struct {
+	// Name and Schema are only set for json_schema
+	Name        string
+	Description string
+	Schema      *jsonschema.Resolved
+	// schemaJSON is the schema as sent by the client, for the prompt
+	schemaJSON string
+	// Strict fails the request when the output never matches the
+	// schema; otherwise the last attempt is returned as-is.
+	Strict bool
+}
+
+// formatError is returned when the model output never matches the
+// requested response_format.
+type formatError struct {
+	Message string
+}
+
+func (e *formatError) Error() string {
+	return e.Message
+}
+
+// parseResponseFormat validates a response_format and resolves its
+// schema. It returns nil for plain text output.
+func parseResponseFormat(rf *ResponseFormat) (*outputFormat, error) {
+	if rf == nil {
+		return nil, nil
+	}
+	switch rf.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &outputFormat{}, nil
+	case "json_schema":
+	default:
+		return nil, fmt.Errorf("unsupported response_format type %q", rf.Type)
+	}
+
+	if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+		return nil, fmt.Errorf("response_format json_schema requires a schema")
+	}
+	var schema jsonschema.Schema
+	if err := json.Unmarshal(rf.JSONSchema.Schema, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema for response_format %q: %v", rf.JSONSchema.Name, err)
+	}
+	resolved, err := schema.Resolve(nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema for response_format %q: %v", rf.JSONSchema.Name, err)
+	}
+	return &outputFormat{
+		Name:        rf.JSONSchema.Name,
+		Description: rf.JSONSchema.Description,
+		Schema:      resolved,
+		schemaJSON:  string(rf.JSONSchema.Schema),
+		Strict:      rf.JSONSchema.Strict != nil && *rf.JSONSchema.Strict,
+	}, nil
+}
+
+// instructions is the system message text asking for the format
+func (f *outputFormat) instructions() string {
+	if f.Schema == nil {
+		return "Respond only with a valid JSON object. Do not wrap it in markdown code fences or add any other text."
+	}
+	var b strings.Builder
+	b.WriteString("Respond only with JSON that conforms to the following JSON Schema")
+	if f.Name != "" {
+		fmt.Fprintf(&b, " (%s)", f.Name)
+	}
+	b.WriteString(". Do not wrap it in markdown code fences or add any other text.")
+	if f.Description != "" {
+		fmt.Fprintf(&b, "\n\n%s", f.Description)
+	}
+	fmt.Fprintf(&b, "\n\n%s", f.schemaJSON)
+	return b.String()
+}
+
+// withInstructions returns messages with the format instructions
+// prepended as a system message.
+func (f *outputFormat) withInstructions(messages []Message) []Message {
+	return append([]Message{{Role: "system", Content: f.instructions()}}, messages...)
+}
+
+// stripCodeFence removes a markdown code fence around the output, which
+// models add despite being asked not to.
+func stripCodeFence(content string) string {
+	trimmed := strings.TrimSpace(content)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return trimmed
+	}
+	inner := strings.TrimSuffix(trimmed[3:], "```")
+	// Drop the language tag on the opening line
+	if idx := strings.IndexByte(inner, '\n'); idx >= 0 && !strings.ContainsAny(inner[:idx], "{[") {
+		inner = inner[idx+1:]
+	}
+	return strings.TrimSpace(inner)
+}
+
+// validate checks the output against the format and returns it without
+// any code fence. schemaErr reports that the output was well-formed JSON
+// that did not match the schema.
+func (f *outputFormat) validate(content string) (output string, schemaErr bool, err error) {
+	output = stripCodeFence(content)
+	var instance interface{}
+	if err := json.Unmarshal([]byte(output), &instance); err != nil {
+		return output, false, fmt.Errorf("the response is not valid JSON: %v", err)
+	}
+	if f.Schema == nil {
+		if _, ok := instance.(map[string]interface{}); !ok {
+			return output, false, fmt.Errorf("the response is not a JSON object")
+		}
+		return output, false, nil
+	}
+	if err := f.Schema.Validate(instance); err != nil {
+		return output, true, fmt.Errorf("the response does not match the schema: %v", err)
+	}
+	return output, false, nil
+}
+
+// correction is the prompt asking the model to fix invalid output
+func (f *outputFormat) correction(err error) string {
+	return fmt.Sprintf("Your previous response was rejected because %v. Respond again with only the corrected JSON.", err)
+}
+
+// runFormatted runs a turn whose output must match the response_format.
+// Text is not streamed as it arrives, since it may have to be replaced;
+// the validated output is delivered as a single delta instead. Tool calls
+// are passed through unchanged.
+func (c *conversation) runFormatted(ctx context.Context, opts turnOptions) (*turnResult, error) {
+	format := c.req.Format
+	inner := opts
+	inner.OnDelta = nil
+
+	result, err := c.runOnce(ctx, inner)
+	for attempt := 1; ; attempt++ {
+		if err != nil {
+			return nil, err
+		}
+		if result.FinishReason == "tool_calls" {
+			return result, nil
+		}
+		// Output cut off by max_tokens cannot be corrected within it
+		if result.FinishReason == "length" {
+			break
+		}
+		output, schemaErr, verr := format.validate(result.Content)
+		if verr == nil {
+			result.Content = output
+			break
+		}
+		if attempt > maxFormatRetries {
+			if schemaErr && !format.Strict {
+				slog.DebugContext(ctx, "Returning output that does not match the non-strict schema", "error", verr)
+				result.Content = output
+				break
+			}
+			slog.ErrorContext(ctx, "Model output does not match response_format", "error", verr)
+			return nil, &formatError{Message: fmt.Sprintf("The model did not produce output matching response_format: %v", verr)}
+		}
+		slog.DebugContext(ctx, "Model output rejected, asking for a correction", "error", verr, "attempt", attempt)
+		spent := result.Usage
+		result, err = runTurn(ctx, c.live.session, copilot.MessageOptions{Prompt: format.correction(verr)}, inner)
+		if err == nil {
+			result.Usage = addUsage(spent, result.Usage)
+		}
+	}
+
+	if opts.OnDelta != nil && result.Content != "" {
+		opts.OnDelta(result.Content)
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+const weatherSchema = `{
+	"type": "object",
+	"properties": {
+		"city": {"type": "string"},
+		"temperature": {"type": "number"}
+	},
+	"required": ["city", "temperature"],
+	"additionalProperties": false
+}`
+
+func mustParseFormat(t *testing.T, body string) *outputFormat {
+	t.Helper()
+	var rf ResponseFormat
+	if err := json.Unmarshal([]byte(body), &rf); err != nil {
+		t.Fatal(err)
+	}
+	format, err := parseResponseFormat(&rf)
+	if err != nil {
+		t.Fatalf("parseResponseFormat: %v", err)
+	}
+	return format
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	if format, err := parseResponseFormat(nil); format != nil || err != nil {
+		t.Error("expected no format when absent")
+	}
+	if format, err := parseResponseFormat(&ResponseFormat{Type: "text"}); format != nil || err != nil {
+		t.Error("expected no format for text")
+	}
+
+	format := mustParseFormat(t, `{"type":"json_schema","json_schema":{"name":"weather","strict":true,"schema":`+weatherSchema+`}}`)
+	if format.Schema == nil || !format.Strict || format.Name != "weather" {
+		t.Errorf("unexpected format %+v", format)
+	}
+
+	for _, body := range []string{
+		`{"type":"yaml"}`,
+		`{"type":"json_schema"}`,
+		`{"type":"json_schema","json_schema":{"name":"bad","schema":{"type":12}}}`,
+	} {
+		var rf ResponseFormat
+		json.Unmarshal([]byte(body), &rf)
+		if _, err := parseResponseFormat(&rf); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestOutputFormatValidate(t *testing.T) {
+	format := mustParseFormat(t, `{"type":"json_schema","json_schema":{"name":"weather","schema":`+weatherSchema+`}}`)
+
+	output, _, err := format.validate("```json\n{\"city\": \"Paris\", \"temperature\": 21}\n```")
+	if err != nil {
+		t.Fatalf("expected fenced valid output to pass: %v", err)
+	}
+	if output != `{"city": "Paris", "temperature": 21}` {
+		t.Errorf("expected the fence to be stripped, got %q", output)
+	}
+
+	if _, schemaErr, err := format.validate(`{"city": "Paris"}`); err == nil || !schemaErr {
+		t.Errorf("expected a schema error for a missing property, got %v", err)
+	}
+	if _, schemaErr, err := format.validate(`The weather is nice`); err == nil || schemaErr {
+		t.Errorf("expected a syntax error for free text, got %v", err)
+	}
+
+	object := mustParseFormat(t, `{"type":"json_object"}`)
+	if _, _, err := object.validate(`{"ok": true}`); err != nil {
+		t.Errorf("expected an object to pass json_object: %v", err)
+	}
+	if _, _, err := object.validate(`[1, 2]`); err == nil {
+		t.Error("expected an array to fail json_object")
+	}
+}
+
+func TestStripCodeFence(t *testing.T) {
+	tests := map[string]string{
+		`{"a":1}`:                 `{"a":1}`,
+		"```\n{\"a\":1}\n```":     `{"a":1}`,
+		"```json\n{\"a\":1}\n```": `{"a":1}`,
+		"  ```{\"a\":1}```  ":     `{"a":1}`,
+		"```json\n[1]\n```\n":     `[1]`,
+		"no fence but ``` inside": "no fence but ``` inside",
+	}
+	for in, want := range tests {
+		if got := stripCodeFence(in); got != want {
+			t.Errorf("stripCodeFence(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestOutputFormatInstructions(t *testing.T) {
+	format := mustParseFormat(t, `{"type":"json_schema","json_schema":{"name":"weather","description":"Current conditions","schema":`+weatherSchema+`}}`)
+	messages := format.withInstructions([]Message{{Role: "user", Content: "weather in Paris?"}})
+	if len(messages) != 2 || messages[0].Role != "system" {
+		t.Fatalf("expected a system message to be prepended, got %+v", messages)
+	}
+	for _, want := range []string{"weather", "Current conditions", `"temperature"`} {
+		if !strings.Contains(messages[0].Content, want) {
+			t.Errorf("expected instructions to mention %q", want)
+		}
+	}
+}
+
+func TestHandleChatCompletions_InvalidResponseFormat(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"x"}}}`
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleChatCompletions(rw, req)
+	if rw.status != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rw.status)
+	}
+}
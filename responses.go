@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStoredResponses bounds how many responses are kept in memory for
+// previous_response_id lookups. The oldest entries are dropped first.
+const maxStoredResponses = 1000
+
+// storedResponse is a completed response together with the conversation
+// that produced it, including the response output as assistant/tool
+// messages, so it can be continued with previous_response_id.
+type storedResponse struct {
+	Owner    string
+	Response ResponseObject
+	Messages []Message
+}
+
+// responseStore keeps recent responses in memory. The zero value is
+// ready to use.
+type responseStore struct {
+	mu      sync.Mutex
+	entries map[string]*storedResponse
+	order   []string
+}
+
+func (rs *responseStore) get(id string) (*storedResponse, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	entry, ok := rs.entries[id]
+	return entry, ok
+}
+
+func (rs *responseStore) put(id string, entry *storedResponse) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.entries == nil {
+		rs.entries = make(map[string]*storedResponse)
+	}
+	if _, exists := rs.entries[id]; !exists {
+		rs.order = append(rs.order, id)
+	}
+	rs.entries[id] = entry
+	for len(rs.order) > maxStoredResponses {
+		delete(rs.entries, rs.order[0])
+		rs.order = rs.order[1:]
+	}
+}
+
+func (rs *responseStore) delete(id string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, ok := rs.entries[id]; !ok {
+		return false
+	}
+	delete(rs.entries, id)
+	for i, existing := range rs.order {
+		if existing == id {
+			rs.order = append(rs.order[:i], rs.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// UnmarshalJSON accepts either a plain string, treated as a single user
+// message, or an array of input items.
+func (in *ResponseInput) UnmarshalJSON(data []byte) error {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, `"`) {
+		*in = ResponseInput{{Type: "message", Role: "user", Content: json.RawMessage(trimmed)}}
+		return nil
+	}
+	var items []ResponseInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*in = items
+	return nil
+}
+
+// responseInputToMessages converts Responses input items into chat
+// messages. Consecutive function_call items are folded into a single
+// assistant message, and function_call_output items become tool
+// messages, matching the chat completions representation.
+func responseInputToMessages(items ResponseInput) ([]Message, error) {
+	var messages []Message
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			msg := Message{Role: item.Role}
+			if msg.Role == "" {
+				msg.Role = "user"
+			}
+			parts, err := responseContentParts(item.Content)
+			if err != nil {
+				return nil, err
+			}
+			if parts == nil {
+				if err := json.Unmarshal(item.Content, &msg.Content); err != nil && len(item.Content) > 0 {
+					return nil, fmt.Errorf("invalid message content")
+				}
+			} else {
+				msg.Parts = parts
+				msg.Content = flattenContentParts(parts)
+			}
+			messages = append(messages, msg)
+
+		case "function_call":
+			call := ToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			}
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, Message{Role: "assistant", ToolCalls: []ToolCall{call}})
+			}
+
+		case "function_call_output":
+			messages = append(messages, Message{
+				Role:       "tool",
+				ToolCallID: item.CallID,
+				Content:    item.Output,
+			})
+
+		case "reasoning":
+			// Reasoning items from previous turns carry no prompt content
+			continue
+
+		default:
+			return nil, fmt.Errorf("unsupported input item type %q", item.Type)
+		}
+	}
+	return messages, nil
+}
+
+// responseContentParts decodes array-form message content into chat
+// content parts. It returns nil parts when the content is a plain string.
+func responseContentParts(raw json.RawMessage) ([]ContentPart, error) {
+	if !strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+		return nil, nil
+	}
+	var items []ResponseInputContent
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("invalid message content")
+	}
+	parts := make([]ContentPart, 0, len(items))
+	for _, item := range items {
+		switch item.Type {
+		case "input_text", "output_text", "text":
+			parts = append(parts, ContentPart{Type: "text", Text: item.Text})
+		case "input_image":
+			parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: item.ImageURL}})
+		default:
+			return nil, fmt.Errorf("unsupported content type %q", item.Type)
+		}
+	}
+	return parts, nil
+}
+
+// responseToolsToChatTools converts Responses tool definitions into the
+// chat completions form used to configure sessions.
+func responseToolsToChatTools(tools []ResponseTool) ([]Tool, error) {
+	converted := make([]Tool, 0, len(tools))
+	for _, tool := range tools {
+		if tool.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool type %q", tool.Type)
+		}
+		converted = append(converted, Tool{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return converted, nil
+}
+
+// responseOutputMessages converts response output items back into chat
+// messages so a stored response can be continued.
+func responseOutputMessages(output []ResponseOutputItem) []Message {
+	msg := Message{Role: "assistant"}
+	for _, item := range output {
+		switch item.Type {
+		case "message":
+			for _, part := range item.Content {
+				msg.Content += part.Text
+			}
+		case "function_call":
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			})
+		}
+	}
+	return []Message{msg}
+}
+
+// responseErrorCode maps an HTTP status onto a Responses error code.
+func responseErrorCode(status int) string {
+	switch status {
+	case http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	case http.StatusBadRequest:
+		return "invalid_prompt"
+	default:
+		return "server_error"
+	}
+}
+
+// HandleResponses handles POST /v1/responses
+func (s *Server) HandleResponses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error")
+		return
+	}
+
+	var req ResponsesRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body", "invalid_request_error")
+		return
+	}
+
+	// enforce API key, either header or body
+	apiKey := getAPIKeyFromHeader(r)
+	if apiKey == "" {
+		apiKey = req.ApiKey
+	}
+	client, err := s.clientFor(r.Context(), apiKey, req.Model)
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return
+	}
+	labelRequest(r.Context(), req.Model, req.Stream)
+
+	if req.Model == "" {
+		writeError(w, http.StatusBadRequest, "Model is required", "invalid_request_error")
+		return
+	}
+
+	if len(req.Input) == 0 {
+		writeError(w, http.StatusBadRequest, "Input is required", "invalid_request_error")
+		return
+	}
+
+	maxTokens, err := parseMaxTokens("max_output_tokens", req.MaxOutputTokens)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	owner := tokenFingerprint(apiKey)
+	var conversation []Message
+	if req.PreviousResponseID != "" {
+		previous, ok := s.responses.get(req.PreviousResponseID)
+		if !ok || previous.Owner != owner {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID), "invalid_request_error")
+			return
+		}
+		conversation = append(conversation, previous.Messages...)
+	}
+
+	input, err := responseInputToMessages(req.Input)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	conversation = append(conversation, input...)
+
+	tools, err := responseToolsToChatTools(req.Tools)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	choice, err := parseToolChoice(req.ToolChoice)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	if tools, err = choice.apply(tools); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	// Instructions apply to this response only and are not carried over
+	// to responses that continue it.
+	sessionMessages := conversation
+	if req.Instructions != "" {
+		sessionMessages = append([]Message{{Role: "system", Content: req.Instructions}}, conversation...)
+	}
+
+	conv, err := s.openConversation(r.Context(), client, conversationRequest{
+		Owner:      owner,
+		SessionID:  sessionIDFromHeader(w, r),
+		Model:      req.Model,
+		Messages:   sessionMessages,
+		Tools:      tools,
+		ToolChoice: choice,
+		Stream:     req.Stream,
+	})
+	if err != nil {
+		status, msg := conversationErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return
+	}
+	defer conv.close()
+
+	response := ResponseObject{
+		ID:                 fmt.Sprintf("resp_%d", time.Now().UnixNano()),
+		Object:             "response",
+		CreatedAt:          currentTimestamp(),
+		Status:             "in_progress",
+		Model:              req.Model,
+		Output:             []ResponseOutputItem{},
+		Instructions:       req.Instructions,
+		PreviousResponseID: req.PreviousResponseID,
+		Tools:              req.Tools,
+		ToolChoice:         req.ToolChoice,
+		ParallelToolCalls:  req.ParallelToolCalls == nil || *req.ParallelToolCalls,
+		Metadata:           req.Metadata,
+	}
+	if response.Tools == nil {
+		response.Tools = []ResponseTool{}
+	}
+	if response.ToolChoice == nil {
+		response.ToolChoice = "auto"
+	}
+
+	opts := turnOptions{MaxTokens: maxTokens, Messages: sessionMessages}
+	var result *turnResult
+	if req.Stream {
+		result, err = s.handleStreamingResponses(r.Context(), w, conv, &response, opts)
+	} else {
+		result, err = s.handleNonStreamingResponses(r.Context(), w, conv, &response, opts)
+	}
+	if err != nil {
+		return
+	}
+	conv.keep(result)
+
+	if req.Store == nil || *req.Store {
+		s.responses.put(response.ID, &storedResponse{
+			Owner:    owner,
+			Response: response,
+			Messages: append(conversation, responseOutputMessages(response.Output)...),
+		})
+	}
+}
+
+// HandleResponse handles GET and DELETE /v1/responses/{id}
+func (s *Server) HandleResponse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error")
+		return
+	}
+
+	apiKey := getAPIKeyFromHeader(r)
+	if _, err := s.clientFor(r.Context(), apiKey, ""); err != nil {
+		status, msg := authErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/responses/")
+	entry, ok := s.responses.get(id)
+	if !ok || entry.Owner != tokenFingerprint(apiKey) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Response with id '%s' not found.", id), "invalid_request_error")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		s.responses.delete(id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":      id,
+			"object":  "response",
+			"deleted": true,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entry.Response)
+}
+
+// responseOutputItems builds the output items of a completed turn
+func responseOutputItems(result *turnResult) []ResponseOutputItem {
+	items := []ResponseOutputItem{}
+	if result.Content != "" {
+		items = append(items, ResponseOutputItem{
+			Type:   "message",
+			ID:     fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+			Status: "completed",
+			Role:   "assistant",
+			Content: []ResponseOutputContent{{
+				Type:        "output_text",
+				Text:        result.Content,
+				Annotations: []interface{}{},
+			}},
+		})
+	}
+	for _, call := range result.ToolCalls {
+		items = append(items, ResponseOutputItem{
+			Type:      "function_call",
+			ID:        "fc_" + call.ID,
+			Status:    "completed",
+			CallID:    call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return items
+}
+
+// finishResponse records the outcome of a completed turn in response: its
+// usage, and whether it was cut off by max_output_tokens.
+func finishResponse(response *ResponseObject, result *turnResult) {
+	response.Usage = &ResponseUsage{
+		InputTokens:  result.Usage.PromptTokens,
+		OutputTokens: result.Usage.CompletionTokens,
+		TotalTokens:  result.Usage.TotalTokens,
+	}
+	response.Status = "completed"
+	if result.FinishReason == "length" {
+		response.Status = "incomplete"
+		response.IncompleteDetails = &ResponseIncompleteDetails{Reason: "max_output_tokens"}
+	}
+}
+
+// handleNonStreamingResponses runs a Responses request to completion and
+// writes the response object. opts carries the output limit.
+func (s *Server) handleNonStreamingResponses(ctx context.Context, w http.ResponseWriter, conv *conversation, response *ResponseObject, opts turnOptions) (*turnResult, error) {
+	result, err := conv.run(ctx, opts)
+	if err != nil {
+		status, msg := turnErrorStatus(err)
+		writeError(w, status, msg, openAIErrorTypeForStatus(status))
+		return nil, err
+	}
+
+	response.Output = responseOutputItems(result)
+	finishResponse(response, result)
+	writeJSON(w, http.StatusOK, response)
+	return result, nil
+}
+
+// handleStreamingResponses streams a Responses request as typed
+// `response.*` SSE events. As with chat completions, nothing is written
+// until the first output arrives so early failures can still be
+// reported with a proper HTTP status. opts carries the output limit.
+func (s *Server) handleStreamingResponses(ctx context.Context, w http.ResponseWriter, conv *conversation, response *ResponseObject, opts turnOptions) (*turnResult, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported", "api_error")
+		return nil, fmt.Errorf("streaming not supported")
+	}
+
+	sequence := 0
+	started := false
+
+	emit := func(event ResponseStreamEvent) {
+		event.SequenceNumber = sequence
+		sequence++
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+	}
+
+	ensureStarted := func() {
+		if started {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		started = true
+		snapshot := *response
+		emit(ResponseStreamEvent{Type: "response.created", Response: &snapshot})
+		emit(ResponseStreamEvent{Type: "response.in_progress", Response: &snapshot})
+	}
+
+	// The currently open assistant message item, if any
+	var text strings.Builder
+	messageOpen := false
+	messageIndex := 0
+	messageID := ""
+
+	openMessage := func() {
+		if messageOpen {
+			return
+		}
+		ensureStarted()
+		messageOpen = true
+		messageIndex = len(response.Output)
+		messageID = fmt.Sprintf("msg_%d", time.Now().UnixNano())
+		text.Reset()
+		item := ResponseOutputItem{
+			Type:    "message",
+			ID:      messageID,
+			Status:  "in_progress",
+			Role:    "assistant",
+			Content: []ResponseOutputContent{},
+		}
+		response.Output = append(response.Output, item)
+		emit(ResponseStreamEvent{Type: "response.output_item.added", OutputIndex: intPtr(messageIndex), Item: &item})
+		emit(ResponseStreamEvent{
+			Type:         "response.content_part.added",
+			ItemID:       messageID,
+			OutputIndex:  intPtr(messageIndex),
+			ContentIndex: intPtr(0),
+			Part:         &ResponseOutputContent{Type: "output_text", Annotations: []interface{}{}},
+		})
+	}
+
+	closeMessage := func() {
+		if !messageOpen {
+			return
+		}
+		messageOpen = false
+		final := text.String()
+		part := ResponseOutputContent{Type: "output_text", Text: final, Annotations: []interface{}{}}
+		emit(ResponseStreamEvent{
+			Type:         "response.output_text.done",
+			ItemID:       messageID,
+			OutputIndex:  intPtr(messageIndex),
+			ContentIndex: intPtr(0),
+			Text:         &final,
+		})
+		emit(ResponseStreamEvent{
+			Type:         "response.content_part.done",
+			ItemID:       messageID,
+			OutputIndex:  intPtr(messageIndex),
+			ContentIndex: intPtr(0),
+			Part:         &part,
+		})
+		item := ResponseOutputItem{
+			Type:    "message",
+			ID:      messageID,
+			Status:  "completed",
+			Role:    "assistant",
+			Content: []ResponseOutputContent{part},
+		}
+		response.Output[messageIndex] = item
+		emit(ResponseStreamEvent{Type: "response.output_item.done", OutputIndex: intPtr(messageIndex), Item: &item})
+	}
+
+	sendText := func(delta string) {
+		openMessage()
+		text.WriteString(delta)
+		emit(ResponseStreamEvent{
+			Type:         "response.output_text.delta",
+			ItemID:       messageID,
+			OutputIndex:  intPtr(messageIndex),
+			ContentIndex: intPtr(0),
+			Delta:        &delta,
+		})
+	}
+
+	streamedText := false
+	opts.OnDelta = func(delta string) {
+		streamedText = true
+		sendText(delta)
+	}
+	opts.OnToolCall = func(index int, call ToolCall) {
+		closeMessage()
+		ensureStarted()
+		outputIndex := len(response.Output)
+		item := ResponseOutputItem{
+			Type:   "function_call",
+			ID:     "fc_" + call.ID,
+			Status: "in_progress",
+			CallID: call.ID,
+			Name:   call.Function.Name,
+		}
+		emit(ResponseStreamEvent{Type: "response.output_item.added", OutputIndex: intPtr(outputIndex), Item: &item})
+		args := call.Function.Arguments
+		emit(ResponseStreamEvent{
+			Type:        "response.function_call_arguments.delta",
+			ItemID:      item.ID,
+			OutputIndex: intPtr(outputIndex),
+			Delta:       &args,
+		})
+		emit(ResponseStreamEvent{
+			Type:        "response.function_call_arguments.done",
+			ItemID:      item.ID,
+			OutputIndex: intPtr(outputIndex),
+			Arguments:   &args,
+		})
+		item.Status = "completed"
+		item.Arguments = args
+		response.Output = append(response.Output, item)
+		emit(ResponseStreamEvent{Type: "response.output_item.done", OutputIndex: intPtr(outputIndex), Item: &item})
+	}
+	result, err := conv.run(ctx, opts)
+	if err != nil {
+		status, msg := turnErrorStatus(err)
+		if !started {
+			writeError(w, status, msg, openAIErrorTypeForStatus(status))
+			return nil, err
+		}
+		closeMessage()
+		response.Status = "failed"
+		response.Error = &ResponseError{Code: responseErrorCode(status), Message: msg}
+		emit(ResponseStreamEvent{Type: "response.failed", Response: response})
+		return nil, err
+	}
+
+	// Models that do not stream deltas still deliver the final content
+	if !streamedText && result.Content != "" {
+		sendText(result.Content)
+	}
+	closeMessage()
+
+	ensureStarted()
+	finishResponse(response, result)
+	emit(ResponseStreamEvent{Type: "response." + response.Status, Response: response})
+	return result, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestResponseInput_StringForm(t *testing.T) {
+	var req ResponsesRequest
+	if err := json.Unmarshal([]byte(`{"model":"gpt-4o","input":"Hello"}`), &req); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	messages, err := responseInputToMessages(req.Input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Role != "user" || messages[0].Content != "Hello" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+}
+
+func TestResponseInputToMessages(t *testing.T) {
+	body := `[
+		{"role":"developer","content":"Be terse."},
+		{"type":"message","role":"user","content":[{"type":"input_text","text":"Weather?"},{"type":"input_image","image_url":"data:image/png;base64,aGk="}]},
+		{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"},
+		{"type":"function_call","call_id":"call_2","name":"get_weather","arguments":"{\"city\":\"Rome\"}"},
+		{"type":"function_call_output","call_id":"call_1","output":"sunny"},
+		{"type":"reasoning","id":"rs_1"}
+	]`
+	var input ResponseInput
+	if err := json.Unmarshal([]byte(body), &input); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	messages, err := responseInputToMessages(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d: %+v", len(messages), messages)
+	}
+	if messages[0].Role != "developer" || messages[0].Content != "Be terse." {
+		t.Errorf("unexpected developer message: %+v", messages[0])
+	}
+	if messages[1].Content != "Weather?" || len(messages[1].Parts) != 2 || messages[1].Parts[1].ImageURL == nil {
+		t.Errorf("unexpected user message: %+v", messages[1])
+	}
+	if messages[2].Role != "assistant" || len(messages[2].ToolCalls) != 2 {
+		t.Errorf("expected function calls folded into one assistant message, got %+v", messages[2])
+	}
+	if messages[3].Role != "tool" || messages[3].ToolCallID != "call_1" || messages[3].Content != "sunny" {
+		t.Errorf("unexpected tool message: %+v", messages[3])
+	}
+
+	prompt := buildPrompt(messages)
+	for _, want := range []string{"[User]: Weather?", "[Assistant called tool get_weather", "[Tool result for call_1]: sunny"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt missing %q. Got:\n%s", want, prompt)
+		}
+	}
+}
+
+func TestResponseInputToMessages_Unsupported(t *testing.T) {
+	for _, body := range []string{
+		`[{"type":"file_search_call","id":"fs_1"}]`,
+		`[{"role":"user","content":[{"type":"input_file","file_id":"file_1"}]}]`,
+	} {
+		var input ResponseInput
+		if err := json.Unmarshal([]byte(body), &input); err != nil {
+			t.Fatalf("unmarshal failed: %v", err)
+		}
+		if _, err := responseInputToMessages(input); err == nil {
+			t.Errorf("expected error for %s", body)
+		}
+	}
+}
+
+func TestResponseToolsToChatTools(t *testing.T) {
+	tools, err := responseToolsToChatTools([]ResponseTool{{
+		Type:        "function",
+		Name:        "get_weather",
+		Description: "Get current weather",
+		Parameters:  map[string]interface{}{"type": "object"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tools) != 1 || tools[0].Type != "function" || tools[0].Function.Name != "get_weather" {
+		t.Fatalf("unexpected tools: %+v", tools)
+	}
+
+	if _, err := responseToolsToChatTools([]ResponseTool{{Type: "web_search"}}); err == nil {
+		t.Fatal("expected error for built-in tool type")
+	}
+}
+
+func TestResponseOutputRoundTrip(t *testing.T) {
+	result := &turnResult{
+		Content:      "Checking.",
+		FinishReason: "tool_calls",
+		ToolCalls: []ToolCall{{
+			ID:       "call_1",
+			Type:     "function",
+			Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		}},
+	}
+
+	items := responseOutputItems(result)
+	if len(items) != 2 || items[0].Type != "message" || items[1].Type != "function_call" || items[1].CallID != "call_1" {
+		t.Fatalf("unexpected output items: %+v", items)
+	}
+
+	messages := responseOutputMessages(items)
+	if len(messages) != 1 || messages[0].Content != "Checking." || len(messages[0].ToolCalls) != 1 {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+}
+
+func TestResponseStore_EvictsOldest(t *testing.T) {
+	var store responseStore
+	for i := 0; i < maxStoredResponses+1; i++ {
+		store.put(fmt.Sprintf("resp_%d", i), &storedResponse{})
+	}
+	if _, ok := store.get("resp_0"); ok {
+		t.Error("expected oldest response to be evicted")
+	}
+	if _, ok := store.get(fmt.Sprintf("resp_%d", maxStoredResponses)); !ok {
+		t.Error("expected newest response to be kept")
+	}
+	if !store.delete("resp_1") {
+		t.Error("expected delete to report an existing response")
+	}
+	if store.delete("resp_1") {
+		t.Error("expected second delete to report a missing response")
+	}
+}
+
+func TestHandleResponses_NoAPIKey(t *testing.T) {
+	srv := &Server{clients: &clientPool{}}
+	req, _ := http.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-4o","input":"hi"}`))
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleResponses(rw, req)
+	if rw.status != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rw.status)
+	}
+}
+
+func TestFinishResponse(t *testing.T) {
+	usage := &Usage{PromptTokens: 12, CompletionTokens: 4, TotalTokens: 16}
+	var response ResponseObject
+	finishResponse(&response, &turnResult{Content: "Hello", FinishReason: "stop", Usage: usage})
+	if response.Status != "completed" || response.IncompleteDetails != nil || response.Usage == nil ||
+		response.Usage.InputTokens != 12 || response.Usage.OutputTokens != 4 || response.Usage.TotalTokens != 16 {
+		t.Errorf("unexpected completed response %+v", response)
+	}
+
+	response = ResponseObject{}
+	finishResponse(&response, &turnResult{Content: "Hel", FinishReason: "length", Usage: usage})
+	if response.Status != "incomplete" || response.IncompleteDetails == nil || response.IncompleteDetails.Reason != "max_output_tokens" {
+		t.Errorf("expected a cut-off response to be incomplete, got %+v", response)
+	}
+}
+
+func TestHandleResponses_InvalidMaxOutputTokens(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	req, _ := http.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-4o","input":"hi","max_output_tokens":0}`))
+	rw := &responseRecorder{head: http.Header{}}
+	srv.HandleResponses(rw, req)
+	if rw.status != http.StatusBadRequest || !strings.Contains(rw.body.String(), "max_output_tokens must be at least 1") {
+		t.Errorf("expected 400 naming max_output_tokens, got %d %s", rw.status, rw.body.String())
+	}
+}
+
+func TestHandleResponses_MaxOutputTokens(t *testing.T) {
+	backend := newFakeBackend(
+		[]copilot.SessionEvent{messageEvent("one two three four five six"), idleEvent()},
+		[]copilot.SessionEvent{messageEvent("Done"), idleEvent()},
+	)
+	_, ts := newFakeServer(t, backend)
+
+	resp := postJSON(t, ts.URL+"/v1/responses", `{"model":"gpt-4o","input":"Count","max_output_tokens":2}`)
+	var response ResponseObject
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "incomplete" || response.IncompleteDetails == nil || response.IncompleteDetails.Reason != "max_output_tokens" {
+		t.Errorf("status = %q, incomplete_details = %+v", response.Status, response.IncompleteDetails)
+	}
+	if text := response.Output[0].Content[0].Text; text != "one two" {
+		t.Errorf("output = %q, want it cut after 2 tokens", text)
+	}
+	if response.Usage == nil || response.Usage.OutputTokens != 2 {
+		t.Errorf("usage = %+v", response.Usage)
+	}
+
+	resp = postJSON(t, ts.URL+"/v1/responses", `{"model":"gpt-4o","input":"Again"}`)
+	response = ResponseObject{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "completed" || response.IncompleteDetails != nil || response.Usage == nil || response.Usage.OutputTokens == 0 {
+		t.Errorf("response = %+v, want completed with estimated usage", response)
+	}
+
+	resp = postJSON(t, ts.URL+"/v1/responses", `{"model":"gpt-4o","input":"Count","max_output_tokens":0}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("max_output_tokens 0: status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// retryPolicy retries turns that fail with a transient Copilot error,
+// each time on a new session that is sent the whole conversation again.
+type retryPolicy struct {
+	// Attempts is the maximum number of attempts of a turn. One or less
+	// disables retries.
+	Attempts int
+	// BaseDelay is the backoff before the first retry. It doubles for
+	// every further retry, up to MaxDelay.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. A retry-after hint longer than MaxDelay
+	// is not waited for and the turn fails.
+	MaxDelay time.Duration
+}
+
+// transientStatuses are the CAPIError statuses worth retrying
+var transientStatuses = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// retryAfterPattern finds a retry-after hint, e.g. "Retry-After: 2" or
+// "retry after 1500ms", in a session error message
+var retryAfterPattern = regexp.MustCompile(`(?i)retry[- _]after\D{0,3}?(\d+(?:\.\d+)?)\s*(ms|s|sec|secs|seconds?)?\b`)
+
+// transientError reports whether err is a Copilot error worth retrying:
+// a CAPIError with a transient status or, lacking a status, a timeout.
+// hint is the delay the error asked for, if it did.
+func transientError(err error) (transient bool, hint time.Duration) {
+	var sessErr *sessionError
+	if !errors.As(err, &sessErr) {
+		return false, 0
+	}
+	if code, ok := capiStatus(sessErr.Message); ok {
+		transient = transientStatuses[code]
+	} else {
+		transient = strings.Contains(strings.ToLower(sessErr.Message), "timeout")
+	}
+	if matches := retryAfterPattern.FindStringSubmatch(sessErr.Message); matches != nil {
+		value, _ := strconv.ParseFloat(matches[1], 64)
+		unit := time.Second
+		if strings.ToLower(matches[2]) == "ms" {
+			unit = time.Millisecond
+		}
+		hint = time.Duration(value * float64(unit))
+	}
+	return transient, hint
+}
+
+// delay returns how long to wait before the given retry, counting from
+// one: exponential backoff with jitter, or the hint if that is longer. ok
+// is false if the hint is longer than MaxDelay.
+func (p retryPolicy) delay(retry int, hint time.Duration) (d time.Duration, ok bool) {
+	if hint > p.MaxDelay {
+		return 0, false
+	}
+	backoff := p.BaseDelay
+	for i := 1; i < retry && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	// Equal jitter keeps retries of concurrent requests from lining up
+	if backoff > 0 {
+		d = backoff/2 + rand.N(backoff/2+1)
+	}
+	if hint > d {
+		d = hint
+	}
+	return d, true
+}
+
+// run runs a turn with attempt, retrying it while it fails with a
+// transient error before any of its output has been passed to the
+// callbacks of opts, as the client cannot be asked to discard what it
+// has been sent. restart prepares a new session before each retry.
+func (p retryPolicy) run(ctx context.Context, opts turnOptions, attempt func(turnOptions) (*turnResult, error), restart func() error) (*turnResult, error) {
+	for n := 1; ; n++ {
+		var streamed atomic.Bool
+		attemptOpts := opts
+		if opts.OnDelta != nil {
+			attemptOpts.OnDelta = func(delta string) {
+				streamed.Store(true)
+				opts.OnDelta(delta)
+			}
+		}
+		if opts.OnToolCall != nil {
+			attemptOpts.OnToolCall = func(index int, call ToolCall) {
+				streamed.Store(true)
+				opts.OnToolCall(index, call)
+			}
+		}
+
+		result, err := attempt(attemptOpts)
+		if err == nil || n >= p.Attempts || streamed.Load() {
+			turnAttempts.Observe(float64(n))
+			return result, err
+		}
+		transient, hint := transientError(err)
+		if !transient {
+			turnAttempts.Observe(float64(n))
+			return result, err
+		}
+		wait, ok := p.delay(n, hint)
+		if !ok {
+			slog.WarnContext(ctx, "Not retrying, upstream asked to wait too long", "attempt", n, "retry_after", hint, "error", err)
+			turnAttempts.Observe(float64(n))
+			return result, err
+		}
+
+		slog.WarnContext(ctx, "Transient upstream error, retrying", "attempt", n, "max_attempts", p.Attempts, "delay", wait, "error", err)
+		markRetry(ctx)
+		select {
+		case <-ctx.Done():
+			turnAttempts.Observe(float64(n))
+			return nil, errClientGone
+		case <-time.After(wait):
+		}
+		if err := restart(); err != nil {
+			turnAttempts.Observe(float64(n))
+			return nil, err
+		}
+	}
+}
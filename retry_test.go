@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+		hint      time.Duration
+	}{
+		{&sessionError{Message: "Last error: CAPIError: 429 429 Too Many Requests"}, true, 0},
+		{&sessionError{Message: "CAPIError: 503 Service Unavailable, Retry-After: 2"}, true, 2 * time.Second},
+		{&sessionError{Message: "CAPIError: 429 rate limited, retry after 1500ms"}, true, 1500 * time.Millisecond},
+		{&sessionError{Message: "CAPIError: 500 Internal Server Error"}, true, 0},
+		{&sessionError{Message: "CAPIError: 400 400 Bad Request"}, false, 0},
+		{&sessionError{Message: "upstream timeout waiting for model"}, true, 0},
+		{&sessionError{Message: "model not supported"}, false, 0},
+		{errTurnTimeout, false, 0},
+		{errors.New("failed to send message"), false, 0},
+	}
+	for _, tt := range tests {
+		transient, hint := transientError(tt.err)
+		if transient != tt.transient || hint != tt.hint {
+			t.Errorf("transientError(%q) = %v, %v; want %v, %v", tt.err, transient, hint, tt.transient, tt.hint)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{Attempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, backoff := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 6: time.Second} {
+		for i := 0; i < 20; i++ {
+			d, ok := p.delay(retry, 0)
+			if !ok || d < backoff/2 || d > backoff {
+				t.Fatalf("delay(%d) = %v, %v; want between %v and %v", retry, d, ok, backoff/2, backoff)
+			}
+		}
+	}
+	if d, ok := p.delay(1, 800*time.Millisecond); !ok || d != 800*time.Millisecond {
+		t.Errorf("delay with hint = %v, %v; want the hint", d, ok)
+	}
+	if _, ok := p.delay(1, 5*time.Second); ok {
+		t.Error("expected a hint beyond MaxDelay not to be retried")
+	}
+}
+
+func TestRetryPolicyRun(t *testing.T) {
+	p := retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	overloaded := &sessionError{Message: "CAPIError: 503 Service Unavailable"}
+	m := &requestMetrics{}
+	ctx := context.WithValue(context.Background(), requestMetricsKey{}, m)
+
+	attempts, restarts := 0, 0
+	result, err := p.run(ctx, turnOptions{}, func(turnOptions) (*turnResult, error) {
+		if attempts++; attempts < 3 {
+			return nil, overloaded
+		}
+		return &turnResult{Content: "ok", FinishReason: "stop"}, nil
+	}, func() error { restarts++; return nil })
+	if err != nil || result.Content != "ok" || attempts != 3 || restarts != 2 || m.retries != 2 {
+		t.Errorf("got %v, %v after %d attempts, %d restarts, %d retries counted", result, err, attempts, restarts, m.retries)
+	}
+
+	// Attempts are bounded
+	attempts = 0
+	if _, err := p.run(ctx, turnOptions{}, func(turnOptions) (*turnResult, error) {
+		attempts++
+		return nil, overloaded
+	}, func() error { return nil }); err != overloaded || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want the error after 3", err, attempts)
+	}
+
+	// Output the client has already seen cannot be taken back
+	attempts = 0
+	var deltas []string
+	opts := turnOptions{OnDelta: func(delta string) { deltas = append(deltas, delta) }}
+	if _, err := p.run(ctx, opts, func(opts turnOptions) (*turnResult, error) {
+		attempts++
+		opts.OnDelta("Hel")
+		return nil, overloaded
+	}, func() error { return nil }); err != overloaded || attempts != 1 || len(deltas) != 1 {
+		t.Errorf("got %v after %d attempts and deltas %q, want no retry", err, attempts, deltas)
+	}
+
+	// Errors that will not go away are not retried
+	attempts = 0
+	p.run(ctx, turnOptions{}, func(turnOptions) (*turnResult, error) {
+		attempts++
+		return nil, &sessionError{Message: "CAPIError: 400 Bad Request"}
+	}, func() error { return nil })
+	if attempts != 1 {
+		t.Errorf("bad request attempted %d times, want 1", attempts)
+	}
+}
+
+func TestChatCompletionRetriesEndToEnd(t *testing.T) {
+	overloaded := "Execution failed: Last error: CAPIError: 503 503 Service Unavailable"
+	backend := newFakeBackend(
+		[]copilot.SessionEvent{errorEvent(overloaded)},
+		[]copilot.SessionEvent{messageEvent("Recovered"), idleEvent()},
+		[]copilot.SessionEvent{deltaEvent("Half"), errorEvent(overloaded)},
+	)
+	srv, ts := newFakeServer(t, backend)
+	srv.config.Retry = retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	resp := postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusOK || backend.created != 2 || len(backend.prompts) != 2 {
+		t.Fatalf("status %d with %d sessions and %d prompts, want 200 after one retry", resp.StatusCode, backend.created, len(backend.prompts))
+	}
+	if backend.prompts[0] != backend.prompts[1] {
+		t.Errorf("retry sent %q, want the original prompt %q", backend.prompts[1], backend.prompts[0])
+	}
+
+	// Once a delta has been streamed the error is passed on instead
+	resp = postJSON(t, ts.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi again"}]}`)
+	readChunks(t, resp)
+	if backend.created != 3 {
+		t.Errorf("created %d sessions, want no retry after streaming", backend.created)
+	}
+	if out := scrapeMetrics(t, srv); !strings.Contains(out, "copilot_server_upstream_retries_total") {
+		t.Error("expected the retry counter in the metrics")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// turnTimeout bounds how long a single prompt may run before the
+// request is abandoned.
+const turnTimeout = 5 * time.Minute
+
+// maxParallelSessions bounds how many sessions a single request runs at
+// once when it asks for several choices.
+const maxParallelSessions = 4
+
+// errTurnTimeout is returned by runTurn when the session does not
+// finish within turnTimeout.
+var errTurnTimeout = errors.New("request timed out")
+
+// errCreateSession wraps failures to create a Copilot session.
+var errCreateSession = errors.New("failed to create session")
+
+// errClientGone is returned by runTurn when the request context is
+// cancelled before the turn finishes.
+var errClientGone = errors.New("client disconnected")
+
+// statusClientClosedRequest is the de facto status for a request the
+// client abandoned; it is only ever logged, as nobody is listening.
+const statusClientClosedRequest = 499
+
+// sessionError carries the message of a SessionError event so callers
+// can map it onto an HTTP status with statusFromSessionError.
+type sessionError struct {
+	Message string
+}
+
+func (e *sessionError) Error() string {
+	return e.Message
+}
+
+// turnResult is the outcome of sending one prompt to a session.
+// StopSequence is set when the output was cut at a stop sequence. Usage
+// holds the token counts reported by the session, or an estimate when it
+// reported none.
+type turnResult struct {
+	Content      string
+	ToolCalls    []ToolCall
+	FinishReason string
+	StopSequence string
+	Usage        *Usage
+}
+
+// turnOptions controls a single turn. Output is cut before the first of
+// the Stop sequences, MaxTokens limits it when positive, and Messages is
+// the conversation the turn answers, from which usage is estimated. The
+// callbacks receive the incremental output; they run on the SDK event
+// goroutine, are never invoked after runTurn returns, and may be nil.
+type turnOptions struct {
+	Stop       []string
+	MaxTokens  int
+	Messages   []Message
+	OnDelta    func(delta string)
+	OnToolCall func(index int, call ToolCall)
+}
+
+// sessionConfigFor builds the Copilot session configuration shared by
+// every API surface. System and developer messages become the session
+// system message. Client tools are registered without handlers;
+// openConversation attaches a toolBridge to them.
+func sessionConfigFor(model string, messages []Message, tools []Tool, streaming bool) *copilot.SessionConfig {
+	// Extract system message - iterate through all messages to find system/developer roles
+	var systemMessageParts []string
+	for _, msg := range messages {
+		if msg.Role == "system" || msg.Role == "developer" {
+			systemMessageParts = append(systemMessageParts, msg.Content)
+		}
+	}
+
+	// Convert OpenAI tools to Copilot tools (definitions only)
+	var copilotTools []copilot.Tool
+	slog.Debug("Received tools in request", "tools", len(tools))
+	for _, tool := range tools {
+		if tool.Type == "function" {
+			copilotTools = append(copilotTools, copilot.Tool{
+				Name:        tool.Function.Name,
+				Description: tool.Function.Description,
+				Parameters:  tool.Function.Parameters,
+			})
+		}
+	}
+
+	sessionConfig := &copilot.SessionConfig{
+		Model:     model,
+		Streaming: streaming,
+		Tools:     copilotTools,
+		// Disable infinite sessions for simple request/response
+		InfiniteSessions: &copilot.InfiniteSessionConfig{
+			Enabled: copilot.Bool(false),
+		},
+	}
+
+	// Add system message if present
+	if len(systemMessageParts) > 0 {
+		systemContent := strings.Join(systemMessageParts, "\n\n")
+		slog.Debug("Setting system message", "length", len(systemContent))
+		sessionConfig.SystemMessage = &copilot.SystemMessageConfig{
+			Mode:    "replace",
+			Content: systemContent,
+		}
+	}
+
+	// If tools are provided, we want to limit available tools to only our custom ones
+	// This prevents Copilot from using built-in file/git tools
+	if len(copilotTools) > 0 {
+		toolNames := make([]string, len(copilotTools))
+		for i, t := range copilotTools {
+			toolNames[i] = t.Name
+		}
+		sessionConfig.AvailableTools = toolNames
+	}
+
+	return sessionConfig
+}
+
+// runTurn sends message to the session and blocks until the session
+// goes idle, requests tools, hits a stop sequence or the token limit,
+// reports an error or times out. Tool requests end the turn immediately
+// because the client is responsible for executing them and sending the
+// results back; output cut at a stop sequence or the token limit aborts
+// the session since the rest of it is discarded.
+func runTurn(ctx context.Context, session copilotSession, message copilot.MessageOptions, opts turnOptions) (*turnResult, error) {
+	return runTurnWith(ctx, session, func() error {
+		_, span := tracer().Start(ctx, "send", trace.WithAttributes(attribute.Int("copilot.attachments", len(message.Attachments))))
+		defer span.End()
+		if _, err := session.Send(message); err != nil {
+			slog.ErrorContext(ctx, "Sending message failed", "session_id", session.ID(), "error", err)
+			return endSpan(span, fmt.Errorf("failed to send message: %w", err))
+		}
+		return nil
+	}, opts)
+}
+
+// createSession creates a Copilot session inside a span. With -record
+// its turns are recorded.
+func (s *Server) createSession(ctx context.Context, client copilotBackend, model string, cfg *copilot.SessionConfig) (copilotSession, error) {
+	_, span := tracer().Start(ctx, "create_session", trace.WithAttributes(
+		semconv.GenAIRequestModel(model),
+		attribute.Int("copilot.tools", len(cfg.Tools)),
+	))
+	defer span.End()
+	var recorder *recordingSession
+	if s.config.RecordDir != "" {
+		recorder = newRecordingSession(s.config.RecordDir, cfg)
+	}
+	session, err := client.CreateSession(cfg)
+	if err != nil {
+		return nil, endSpan(span, err)
+	}
+	span.SetAttributes(semconv.GenAIConversationID(session.ID()))
+	if recorder != nil {
+		return recorder.wrap(session), nil
+	}
+	return session, nil
+}
+
+// runTurnWith is runTurn with the step that sets the session going
+// supplied by the caller: sending a prompt, or delivering tool results to
+// a session that is waiting for them. If ctx is cancelled, because the
+// client went away, or the turn times out, the session is aborted so it
+// stops generating.
+func runTurnWith(ctx context.Context, session copilotSession, start func() error, opts turnOptions) (*turnResult, error) {
+	result := &turnResult{FinishReason: "stop"}
+	var content, streamed strings.Builder
+	var failed, stoppedInDelta, truncated bool
+	var sessionErrMessage string
+	scanner := newStopScanner(opts.Stop)
+	budget := newTokenBudget(defaultTokenizer, opts.MaxTokens)
+
+	var mu sync.Mutex
+	finished := false
+	done := make(chan struct{})
+	finish := func() {
+		if !finished {
+			finished = true
+			close(done)
+		}
+	}
+
+	emitDelta := func(text string) {
+		if text == "" || truncated {
+			return
+		}
+		if budget != nil {
+			var over bool
+			if text, over = budget.Push(text); over {
+				result.FinishReason = "length"
+				truncated = true
+				finish()
+			}
+		}
+		if streamed.Len() == 0 {
+			addTurnEvent(ctx, "gen_ai.first_delta")
+		}
+		streamed.WriteString(text)
+		if opts.OnDelta != nil {
+			opts.OnDelta(text)
+		}
+	}
+
+	unsubscribe := session.On(func(event copilot.SessionEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return
+		}
+
+		switch event.Type {
+		case copilot.AssistantMessageDelta:
+			if event.Data.DeltaContent == nil {
+				return
+			}
+			markFirstToken(ctx)
+			if scanner == nil {
+				emitDelta(*event.Data.DeltaContent)
+				return
+			}
+			text, stop, found := scanner.Push(*event.Data.DeltaContent)
+			emitDelta(text)
+			if found && !truncated {
+				result.StopSequence = stop
+				stoppedInDelta = true
+				finish()
+			}
+
+		case copilot.AssistantMessage:
+			markFirstToken(ctx)
+			// The message is complete, so held-back text can no longer
+			// become a stop sequence
+			if scanner != nil {
+				emitDelta(scanner.Flush())
+			}
+			if truncated {
+				return
+			}
+			// Capture final content
+			if event.Data.Content != nil {
+				content.WriteString(*event.Data.Content)
+				if cut, stop, found := truncateAtStop(content.String(), opts.Stop); found {
+					content.Reset()
+					content.WriteString(cut)
+					result.StopSequence = stop
+					finish()
+					return
+				}
+				// Without deltas the limit is applied to the whole message
+				if budget != nil && streamed.Len() == 0 {
+					if cut, over := budget.Push(content.String()); over {
+						content.Reset()
+						content.WriteString(cut)
+						result.FinishReason = "length"
+						finish()
+						return
+					}
+				}
+			}
+			// Check for tool requests
+			if len(event.Data.ToolRequests) > 0 {
+				slog.DebugContext(ctx, "Assistant requested tools", "session_id", session.ID(), "tool_requests", len(event.Data.ToolRequests))
+				result.FinishReason = "tool_calls"
+				for _, tr := range event.Data.ToolRequests {
+					argsJSON, _ := json.Marshal(tr.Arguments)
+					call := ToolCall{
+						ID:   tr.ToolCallID,
+						Type: "function",
+						Function: ToolCallFunction{
+							Name:      tr.Name,
+							Arguments: string(argsJSON),
+						},
+					}
+					result.ToolCalls = append(result.ToolCalls, call)
+					addTurnEvent(ctx, "gen_ai.tool_call", semconv.GenAIToolName(tr.Name), semconv.GenAIToolCallID(tr.ToolCallID))
+					if opts.OnToolCall != nil {
+						opts.OnToolCall(len(result.ToolCalls)-1, call)
+					}
+				}
+				// Return immediately - client needs to execute tools and send results back
+				finish()
+			}
+
+		case copilot.AssistantUsage:
+			// One event per model call, so a turn may report several
+			usage := &Usage{}
+			if event.Data.InputTokens != nil {
+				usage.PromptTokens = int(*event.Data.InputTokens)
+			}
+			if event.Data.OutputTokens != nil {
+				usage.CompletionTokens = int(*event.Data.OutputTokens)
+			}
+			result.Usage = addUsage(result.Usage, usage)
+
+		case copilot.SessionIdle:
+			if scanner != nil {
+				emitDelta(scanner.Flush())
+			}
+			finish()
+
+		case copilot.SessionError:
+			failed = true
+			if event.Data.Message != nil {
+				sessionErrMessage = *event.Data.Message
+				slog.ErrorContext(ctx, "Session error", "session_id", session.ID(), "error", sessionErrMessage)
+			}
+			finish()
+		}
+	})
+	defer unsubscribe()
+
+	if err := start(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		slog.InfoContext(ctx, "Client disconnected, aborting session", "session_id", session.ID())
+		if err := session.Abort(); err != nil {
+			slog.ErrorContext(ctx, "Aborting session failed", "session_id", session.ID(), "error", err)
+		}
+		return nil, errClientGone
+	case <-time.After(turnTimeout):
+		slog.WarnContext(ctx, "Turn timed out, aborting session", "session_id", session.ID(), "timeout", turnTimeout)
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		if err := session.Abort(); err != nil {
+			slog.ErrorContext(ctx, "Aborting session failed", "session_id", session.ID(), "error", err)
+		}
+		return nil, errTurnTimeout
+	}
+
+	mu.Lock()
+	if failed {
+		mu.Unlock()
+		return nil, &sessionError{Message: sessionErrMessage}
+	}
+	result.Content = content.String()
+	if stoppedInDelta || truncated {
+		result.Content = streamed.String()
+	}
+	mu.Unlock()
+
+	// Abort outside the lock: the SDK may still be delivering events
+	if result.StopSequence != "" || result.FinishReason == "length" {
+		slog.DebugContext(ctx, "Output cut off, aborting session", "session_id", session.ID(), "stop", result.StopSequence, "finish_reason", result.FinishReason)
+		if err := session.Abort(); err != nil {
+			slog.ErrorContext(ctx, "Aborting session failed", "session_id", session.ID(), "error", err)
+		}
+	}
+	if result.Usage == nil {
+		result.Usage = estimateUsage(opts.Messages, result)
+	}
+	return result, nil
+}
+
+// addUsage returns the sum of two usages, either of which may be nil
+func addUsage(a, b *Usage) *Usage {
+	if a == nil {
+		a, b = b, a
+	}
+	if b == nil {
+		return a
+	}
+	sum := &Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+	}
+	sum.TotalTokens = sum.PromptTokens + sum.CompletionTokens
+	return sum
+}
+
+// forEachChoice calls fn for every index in [0, count) with at most
+// maxParallelSessions calls in flight, and waits for all of them.
+func forEachChoice(count int, fn func(index int)) {
+	sem := make(chan struct{}, maxParallelSessions)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(index)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// turnErrorStatus maps an error returned by runTurn onto an HTTP
+// status code and a client-facing message.
+func turnErrorStatus(err error) (int, string) {
+	var sessErr *sessionError
+	var choiceErr *toolChoiceError
+	var formatErr *formatError
+	switch {
+	case errors.Is(err, errTurnTimeout):
+		return http.StatusGatewayTimeout, "Request timed out"
+	case errors.Is(err, errClientGone):
+		return statusClientClosedRequest, "Client closed request"
+	case errors.As(err, &choiceErr):
+		return http.StatusBadGateway, choiceErr.Message
+	case errors.As(err, &formatErr):
+		return http.StatusBadGateway, formatErr.Message
+	case errors.Is(err, errCreateSession):
+		return http.StatusInternalServerError, "Failed to create session"
+	case errors.As(err, &sessErr):
+		return statusFromSessionError(sessErr.Message), userMessageFromSessionError(sessErr.Message)
+	default:
+		return http.StatusInternalServerError, "Failed to send message"
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestTurnErrorStatusClientGone(t *testing.T) {
+	status, _ := turnErrorStatus(errClientGone)
+	if status != statusClientClosedRequest {
+		t.Fatalf("expected %d for a disconnected client, got %d", statusClientClosedRequest, status)
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	if addUsage(nil, nil) != nil {
+		t.Error("expected no usage when neither side has any")
+	}
+	one := &Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+	if got := addUsage(nil, one); got != one {
+		t.Errorf("expected the only usage to be returned, got %+v", got)
+	}
+	got := addUsage(one, &Usage{PromptTokens: 10, CompletionTokens: 7})
+	if got.PromptTokens != 20 || got.CompletionTokens != 12 || got.TotalTokens != 32 {
+		t.Errorf("unexpected sum %+v", got)
+	}
+}
+
+func TestHandleChatCompletions_InvalidN(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	for _, n := range []string{"0", "-1", "17"} {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"n":` + n + `}`
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		rw := &responseRecorder{head: http.Header{}}
+		srv.HandleChatCompletions(rw, req)
+		if rw.status != http.StatusBadRequest {
+			t.Errorf("expected 400 for n=%s, got %d", n, rw.status)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxStopSequences is the number of stop sequences OpenAI accepts
+const maxStopSequences = 4
+
+// parseStop decodes an OpenAI `stop` value, which may be a string or an
+// array of strings.
+func parseStop(v interface{}) ([]string, error) {
+	switch stop := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{stop}, nil
+	case []interface{}:
+		if len(stop) > maxStopSequences {
+			return nil, fmt.Errorf("stop may contain at most %d sequences", maxStopSequences)
+		}
+		stops := make([]string, 0, len(stop))
+		for _, item := range stop {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("stop must be a string or an array of strings")
+			}
+			stops = append(stops, s)
+		}
+		return stops, nil
+	default:
+		return nil, fmt.Errorf("stop must be a string or an array of strings")
+	}
+}
+
+// stopScanner finds the first stop sequence in a stream of text deltas.
+// A stop sequence can straddle two deltas, so any trailing text that could
+// still turn into a stop sequence is held back until the next delta (or
+// Flush) settles it.
+type stopScanner struct {
+	stops   []string
+	pending string
+}
+
+// newStopScanner returns a scanner for the non-empty stop sequences, or
+// nil when there are none.
+func newStopScanner(stops []string) *stopScanner {
+	var filtered []string
+	for _, stop := range stops {
+		if stop != "" {
+			filtered = append(filtered, stop)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return &stopScanner{stops: filtered}
+}
+
+// Push adds a delta and returns the text that is safe to emit. When a
+// stop sequence is found, the text before it is returned together with
+// the matched sequence, and everything after it is discarded.
+func (sc *stopScanner) Push(delta string) (text, stop string, found bool) {
+	buf := sc.pending + delta
+	sc.pending = ""
+
+	if idx, stop := indexStop(buf, sc.stops); idx >= 0 {
+		return buf[:idx], stop, true
+	}
+
+	// Hold back the longest suffix that is a prefix of some stop sequence
+	hold := 0
+	for _, stop := range sc.stops {
+		for k := min(len(stop)-1, len(buf)); k > hold; k-- {
+			if strings.HasSuffix(buf, stop[:k]) {
+				hold = k
+				break
+			}
+		}
+	}
+	sc.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], "", false
+}
+
+// Flush returns any held-back text once the stream has ended.
+func (sc *stopScanner) Flush() string {
+	text := sc.pending
+	sc.pending = ""
+	return text
+}
+
+// truncateAtStop cuts text at the first stop sequence, if any.
+func truncateAtStop(text string, stops []string) (string, string, bool) {
+	if idx, stop := indexStop(text, stops); idx >= 0 {
+		return text[:idx], stop, true
+	}
+	return text, "", false
+}
+
+// indexStop returns the position and value of the earliest stop sequence
+// in text, or -1 when none occurs.
+func indexStop(text string, stops []string) (int, string) {
+	best, match := -1, ""
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if idx := strings.Index(text, stop); idx >= 0 && (best < 0 || idx < best) {
+			best, match = idx, stop
+		}
+	}
+	return best, match
+}
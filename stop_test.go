@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestStopScanner(t *testing.T) {
+	tests := []struct {
+		name     string
+		stops    []string
+		deltas   []string
+		want     string
+		wantStop string
+	}{
+		{
+			name:   "No match passes text through",
+			stops:  []string{"END"},
+			deltas: []string{"Hello ", "world"},
+			want:   "Hello world",
+		},
+		{
+			name:     "Match within a delta",
+			stops:    []string{"END"},
+			deltas:   []string{"Hello END world"},
+			want:     "Hello ",
+			wantStop: "END",
+		},
+		{
+			name:     "Match straddling deltas",
+			stops:    []string{"\n\nHuman:"},
+			deltas:   []string{"Answer.\n", "\nHum", "an: next"},
+			want:     "Answer.",
+			wantStop: "\n\nHuman:",
+		},
+		{
+			name:   "Held-back prefix released when it does not match",
+			stops:  []string{"STOP"},
+			deltas: []string{"ST", "ART"},
+			want:   "START",
+		},
+		{
+			name:     "Earliest of several stops wins",
+			stops:    []string{"b", "a"},
+			deltas:   []string{"xxab"},
+			want:     "xx",
+			wantStop: "a",
+		},
+		{
+			name:   "Multi-byte text is never split",
+			stops:  []string{"ü!"},
+			deltas: []string{"grün", "ü", "x"},
+			want:   "grünüx",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newStopScanner(tt.stops)
+			var out strings.Builder
+			var stop string
+			for _, delta := range tt.deltas {
+				text, matched, found := sc.Push(delta)
+				out.WriteString(text)
+				if found {
+					stop = matched
+					break
+				}
+			}
+			if stop == "" {
+				out.WriteString(sc.Flush())
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+			if stop != tt.wantStop {
+				t.Errorf("stop = %q, want %q", stop, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestNewStopScanner_Empty(t *testing.T) {
+	if sc := newStopScanner([]string{"", ""}); sc != nil {
+		t.Fatal("expected nil scanner when there are no stop sequences")
+	}
+}
+
+func TestTruncateAtStop(t *testing.T) {
+	got, stop, found := truncateAtStop("one\ntwo\nthree", []string{"three", "\n"})
+	if !found || got != "one" || stop != "\n" {
+		t.Fatalf("truncateAtStop() = %q, %q, %v", got, stop, found)
+	}
+	if got, _, found := truncateAtStop("plain", nil); found || got != "plain" {
+		t.Fatalf("expected text unchanged without stops, got %q", got)
+	}
+}
+
+func TestHandleChatCompletions_InvalidStop(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	for _, stop := range []string{`12`, `["a", 1]`, `["a","b","c","d","e"]`} {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stop":` + stop + `}`
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		rw := &responseRecorder{head: http.Header{}}
+		srv.HandleChatCompletions(rw, req)
+		if rw.status != http.StatusBadRequest {
+			t.Errorf("expected 400 for stop %s, got %d", stop, rw.status)
+		}
+	}
+}
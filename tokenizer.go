@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// tokenizer splits text into model tokens. It is used to enforce output
+// limits, so any implementation will do as long as the tokens concatenate
+// back to the text.
+type tokenizer interface {
+	Tokens(text string) []string
+}
+
+// defaultTokenizer is the tokenizer used for output limits and usage
+// estimates. It is set by loadTokenizer when the server starts.
+var defaultTokenizer tokenizer
+
+// loadTokenizer sets defaultTokenizer to the bundled o200k_base encoding.
+// The work is only done once; it fails if the embedded ranks cannot be
+// read.
+var loadTokenizer = sync.OnceValue(func() error {
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	enc, err := tiktoken.GetEncoding("o200k_base")
+	if err != nil {
+		return fmt.Errorf("loading o200k_base tokenizer: %w", err)
+	}
+	defaultTokenizer = bpeTokenizer{enc: enc}
+	return nil
+})
+
+// bpeTokenizer splits text with one of OpenAI's BPE encodings, whose
+// ranks are compiled into the binary. o200k_base is the encoding of the
+// GPT-4o and later models; other model families have their own
+// tokenizers, so counts for them are estimates.
+type bpeTokenizer struct {
+	enc *tiktoken.Tiktoken
+}
+
+func (t bpeTokenizer) Tokens(text string) []string {
+	ids := t.enc.EncodeOrdinary(text)
+	tokens := make([]string, len(ids))
+	for i, id := range ids {
+		tokens[i] = t.enc.Decode([]int{id})
+	}
+	return tokens
+}
+
+// tokenBudget cuts a stream of text deltas off after a number of tokens.
+// Deltas are tokenized together with the last token of the text before
+// them, since it may still grow into a longer token.
+type tokenBudget struct {
+	tok  tokenizer
+	max  int
+	used int
+	tail string
+}
+
+// newTokenBudget returns a budget of max tokens, or nil when max is not
+// positive.
+func newTokenBudget(tok tokenizer, max int) *tokenBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &tokenBudget{tok: tok, max: max}
+}
+
+// Push returns the part of text that fits in the budget, and whether
+// text went over it.
+func (b *tokenBudget) Push(text string) (string, bool) {
+	if text == "" {
+		return "", false
+	}
+	tokens := b.tok.Tokens(b.tail + text)
+	if len(tokens) == 0 {
+		return text, false
+	}
+	allowed := b.max - b.used
+	if len(tokens) <= allowed {
+		b.used += len(tokens) - 1
+		b.tail = tokens[len(tokens)-1]
+		return text, false
+	}
+	kept := strings.Join(tokens[:allowed], "")
+	// A token may end inside a multi-byte character; never send half of
+	// one
+	for kept != "" {
+		if r, size := utf8.DecodeLastRuneInString(kept); r != utf8.RuneError || size != 1 {
+			break
+		}
+		kept = kept[:len(kept)-1]
+	}
+	b.used = b.max
+	if len(kept) <= len(b.tail) {
+		return "", true
+	}
+	return kept[len(b.tail):], true
+}
+
+// parseMaxTokens validates an optional output token limit sent in the
+// named field. It returns 0 when there is no limit.
+func parseMaxTokens(field string, v *int) (int, error) {
+	if v == nil {
+		return 0, nil
+	}
+	if *v < 1 {
+		return 0, fmt.Errorf("%s must be at least 1", field)
+	}
+	return *v, nil
+}
+
+// estimateUsage estimates the usage of a turn that answered messages
+// with result, for sessions that report no token counts.
+func estimateUsage(messages []Message, result *turnResult) *Usage {
+	// Like OpenAI, count a few tokens of framing per message and for the
+	// start of the reply
+	prompt := 3
+	for _, msg := range messages {
+		prompt += 3 + len(defaultTokenizer.Tokens(msg.Content))
+	}
+	completion := len(defaultTokenizer.Tokens(result.Content))
+	for _, call := range result.ToolCalls {
+		completion += len(defaultTokenizer.Tokens(call.Function.Name)) + len(defaultTokenizer.Tokens(call.Function.Arguments))
+	}
+	return &Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestMain(m *testing.M) {
+	if err := loadTokenizer(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestBPETokenizer(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"Hello world", 2},
+		{"Hello, world!", 4},
+		{"I'm here", 2},
+		{"12345", 2},
+		{"internationalization", 2},
+		{"for i := range xs {", 6},
+		{"こんにちは世界", 2},
+		{"Привет, мир", 4},
+		{"🎉🎉", 4},
+	}
+	for _, tt := range tests {
+		tokens := defaultTokenizer.Tokens(tt.text)
+		if len(tokens) != tt.want {
+			t.Errorf("Tokens(%q) = %q, want %d tokens", tt.text, tokens, tt.want)
+		}
+		if joined := strings.Join(tokens, ""); joined != tt.text {
+			t.Errorf("tokens of %q join to %q", tt.text, joined)
+		}
+	}
+}
+
+func TestTokenBudget(t *testing.T) {
+	budget := newTokenBudget(defaultTokenizer, 4)
+	var out strings.Builder
+	for _, delta := range []string{"The qu", "ick brown", " fox jumps", " over"} {
+		text, over := budget.Push(delta)
+		out.WriteString(text)
+		if over {
+			break
+		}
+	}
+	if got := out.String(); got != "The quick brown fox" {
+		t.Errorf("expected output cut after four tokens, got %q", got)
+	}
+
+	budget = newTokenBudget(defaultTokenizer, 2)
+	if text, over := budget.Push("one two three"); !over || text != "one two" {
+		t.Errorf("expected a single delta to be cut, got %q, %v", text, over)
+	}
+	// The budget is never cut inside a character split across tokens
+	budget = newTokenBudget(defaultTokenizer, 3)
+	if text, over := budget.Push("🎉🎉"); !over || text != "🎉" {
+		t.Errorf("expected the second emoji to be dropped whole, got %q, %v", text, over)
+	}
+	if newTokenBudget(defaultTokenizer, 0) != nil {
+		t.Error("expected no budget without a limit")
+	}
+}
+
+func TestParseMaxTokens(t *testing.T) {
+	if n, err := parseMaxTokens("max_output_tokens", nil); n != 0 || err != nil {
+		t.Errorf("got %d, %v without a limit", n, err)
+	}
+	limit := 0
+	if _, err := parseMaxTokens("max_output_tokens", &limit); err == nil || err.Error() != "max_output_tokens must be at least 1" {
+		t.Errorf("expected the error to name the field, got %v", err)
+	}
+}
+
+func TestEstimateUsage(t *testing.T) {
+	messages := []Message{{Role: "user", Content: "Hello world"}}
+	got := estimateUsage(messages, &turnResult{Content: "Hi there", ToolCalls: []ToolCall{
+		{Function: ToolCallFunction{Name: "get_weather", Arguments: `{}`}},
+	}})
+	if got.PromptTokens != 8 || got.CompletionTokens != 5 || got.TotalTokens != 13 {
+		t.Errorf("unexpected estimate %+v", got)
+	}
+}
+
+func TestHandleChatCompletions_InvalidMaxTokens(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{`"max_tokens":0`, "max_tokens must be at least 1"},
+		{`"max_completion_tokens":-5`, "max_completion_tokens must be at least 1"},
+		{`"max_tokens":10,"max_completion_tokens":0`, "max_completion_tokens must be at least 1"},
+	}
+	for _, tt := range tests {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],` + tt.field + `}`
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		rw := &responseRecorder{head: http.Header{}}
+		srv.HandleChatCompletions(rw, req)
+		if rw.status != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", tt.field, rw.status)
+		}
+		if !strings.Contains(rw.body.String(), tt.want) {
+			t.Errorf("expected %q for %s, got %s", tt.want, tt.field, rw.body.String())
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// maxToolChoiceRetries is how many times a model that answers in text is
+// reminded to call a tool before the request fails.
+const maxToolChoiceRetries = 2
+
+// toolChoice is a parsed tool_choice. Mode is "auto", "none", "required"
+// or "function", in which case Name is the tool the model must call.
+type toolChoice struct {
+	Mode string
+	Name string
+}
+
+// toolChoiceError is returned when the model does not comply with a
+// forced tool_choice.
+type toolChoiceError struct {
+	Message string
+}
+
+func (e *toolChoiceError) Error() string {
+	return e.Message
+}
+
+// parseToolChoice decodes a tool_choice given as a string or as an
+// object naming a function. Both the chat completions form
+// {"type":"function","function":{"name":...}} and the Responses form
+// {"type":"function","name":...} are accepted.
+func parseToolChoice(v interface{}) (toolChoice, error) {
+	switch choice := v.(type) {
+	case nil:
+		return toolChoice{Mode: "auto"}, nil
+	case string:
+		switch choice {
+		case "auto", "none", "required":
+			return toolChoice{Mode: choice}, nil
+		}
+		return toolChoice{}, fmt.Errorf("tool_choice must be one of 'none', 'auto', 'required' or a function")
+	case map[string]interface{}:
+		if choice["type"] != "function" {
+			return toolChoice{}, fmt.Errorf("unsupported tool_choice type %v", choice["type"])
+		}
+		name, _ := choice["name"].(string)
+		if fn, ok := choice["function"].(map[string]interface{}); ok {
+			name, _ = fn["name"].(string)
+		}
+		if name == "" {
+			return toolChoice{}, fmt.Errorf("tool_choice function name is required")
+		}
+		return toolChoice{Mode: "function", Name: name}, nil
+	default:
+		return toolChoice{}, fmt.Errorf("tool_choice must be a string or an object")
+	}
+}
+
+// anthropicToolChoice converts an Anthropic tool_choice, where "any"
+// forces some tool and "tool" forces a named one.
+func anthropicToolChoice(choice *AnthropicToolChoice) toolChoice {
+	if choice == nil {
+		return toolChoice{Mode: "auto"}
+	}
+	switch choice.Type {
+	case "none":
+		return toolChoice{Mode: "none"}
+	case "any":
+		return toolChoice{Mode: "required"}
+	case "tool":
+		return toolChoice{Mode: "function", Name: choice.Name}
+	default:
+		return toolChoice{Mode: "auto"}
+	}
+}
+
+// apply narrows tools to those the model may call: none for "none", and
+// only the named tool for "function".
+func (c toolChoice) apply(tools []Tool) ([]Tool, error) {
+	switch c.Mode {
+	case "none":
+		return nil, nil
+	case "required":
+		if len(tools) == 0 {
+			return nil, fmt.Errorf("tool_choice 'required' is only allowed when tools are specified")
+		}
+	case "function":
+		for _, tool := range tools {
+			if tool.Function.Name == c.Name {
+				return []Tool{tool}, nil
+			}
+		}
+		return nil, fmt.Errorf("tool_choice references unknown tool %q", c.Name)
+	}
+	return tools, nil
+}
+
+// forced reports whether the model must answer with a tool call
+func (c toolChoice) forced() bool {
+	return c.Mode == "required" || c.Mode == "function"
+}
+
+// reminder is the prompt sent when the model answered in text
+func (c toolChoice) reminder() string {
+	if c.Mode == "function" {
+		return fmt.Sprintf("You must respond by calling the %s tool. Do not answer in text.", c.Name)
+	}
+	return "You must respond by calling one of the available tools. Do not answer in text."
+}
+
+// violation describes how a turn failed to comply with the tool choice,
+// or returns "" if it complied. retry is true when the model answered in
+// text and can be reminded; a call to the wrong tool cannot be taken back.
+func (c toolChoice) violation(result *turnResult) (msg string, retry bool) {
+	if result.FinishReason != "tool_calls" {
+		if c.Mode == "function" {
+			return fmt.Sprintf("The model did not call the required tool %q", c.Name), true
+		}
+		return "The model did not call a tool as required by tool_choice", true
+	}
+	if c.Mode == "function" {
+		for _, call := range result.ToolCalls {
+			if call.Function.Name != c.Name {
+				return fmt.Sprintf("The model called %q instead of the required tool %q", call.Function.Name, c.Name), false
+			}
+		}
+	}
+	return "", false
+}
+
+// runForced runs a turn that must end in a tool call. Streamed text is
+// held back until a tool call arrives, so a text-only answer can be
+// discarded and the model reminded to call a tool instead.
+func (c *conversation) runForced(ctx context.Context, opts turnOptions) (*turnResult, error) {
+	choice := c.req.ToolChoice
+	var held strings.Builder
+
+	inner := opts
+	inner.OnDelta = func(delta string) {
+		held.WriteString(delta)
+	}
+	inner.OnToolCall = func(index int, call ToolCall) {
+		if held.Len() > 0 && opts.OnDelta != nil {
+			opts.OnDelta(held.String())
+		}
+		held.Reset()
+		if opts.OnToolCall != nil {
+			opts.OnToolCall(index, call)
+		}
+	}
+
+	result, err := c.runOnce(ctx, inner)
+	for attempt := 1; ; attempt++ {
+		if err != nil {
+			return nil, err
+		}
+		// Output cut off by max_tokens is returned as it is
+		if result.FinishReason == "length" {
+			if held.Len() > 0 && opts.OnDelta != nil {
+				opts.OnDelta(held.String())
+			}
+			return result, nil
+		}
+		msg, retry := choice.violation(result)
+		if msg == "" {
+			return result, nil
+		}
+		if !retry || attempt > maxToolChoiceRetries {
+			slog.ErrorContext(ctx, "Model did not honor tool_choice", "tool_choice", choice.Mode, "error", msg)
+			return nil, &toolChoiceError{Message: msg}
+		}
+		slog.DebugContext(ctx, "Model answered in text despite tool_choice, reminding it", "tool_choice", choice.Mode, "attempt", attempt)
+		held.Reset()
+		spent := result.Usage
+		result, err = runTurn(ctx, c.live.session, copilot.MessageOptions{Prompt: choice.reminder()}, inner)
+		if err == nil {
+			result.Usage = addUsage(spent, result.Usage)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestParseToolChoice(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    toolChoice
+		wantErr bool
+	}{
+		{"absent", `null`, toolChoice{Mode: "auto"}, false},
+		{"auto", `"auto"`, toolChoice{Mode: "auto"}, false},
+		{"none", `"none"`, toolChoice{Mode: "none"}, false},
+		{"required", `"required"`, toolChoice{Mode: "required"}, false},
+		{"chat function", `{"type":"function","function":{"name":"get_weather"}}`, toolChoice{Mode: "function", Name: "get_weather"}, false},
+		{"responses function", `{"type":"function","name":"get_weather"}`, toolChoice{Mode: "function", Name: "get_weather"}, false},
+		{"unknown string", `"sometimes"`, toolChoice{}, true},
+		{"missing name", `{"type":"function","function":{}}`, toolChoice{}, true},
+		{"unsupported type", `{"type":"file_search"}`, toolChoice{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.input), &v); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseToolChoice(v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolChoiceApply(t *testing.T) {
+	tools := []Tool{
+		{Type: "function", Function: ToolFunction{Name: "get_weather"}},
+		{Type: "function", Function: ToolFunction{Name: "get_time"}},
+	}
+
+	if got, _ := (toolChoice{Mode: "auto"}).apply(tools); len(got) != 2 {
+		t.Errorf("auto: expected all tools, got %d", len(got))
+	}
+	if got, _ := (toolChoice{Mode: "none"}).apply(tools); got != nil {
+		t.Errorf("none: expected no tools, got %d", len(got))
+	}
+	got, err := (toolChoice{Mode: "function", Name: "get_time"}).apply(tools)
+	if err != nil || len(got) != 1 || got[0].Function.Name != "get_time" {
+		t.Errorf("function: expected only get_time, got %+v, %v", got, err)
+	}
+	if _, err := (toolChoice{Mode: "function", Name: "missing"}).apply(tools); err == nil {
+		t.Error("expected an error for an unknown tool")
+	}
+	if _, err := (toolChoice{Mode: "required"}).apply(nil); err == nil {
+		t.Error("expected an error for required without tools")
+	}
+}
+
+func TestToolChoiceViolation(t *testing.T) {
+	text := &turnResult{Content: "It is sunny.", FinishReason: "stop"}
+	call := &turnResult{FinishReason: "tool_calls", ToolCalls: []ToolCall{
+		{ID: "call_1", Function: ToolCallFunction{Name: "get_weather"}},
+	}}
+
+	if msg, retry := (toolChoice{Mode: "required"}).violation(text); msg == "" || !retry {
+		t.Error("expected a text answer to be retried under required")
+	}
+	if msg, _ := (toolChoice{Mode: "required"}).violation(call); msg != "" {
+		t.Errorf("expected a tool call to satisfy required, got %q", msg)
+	}
+	if msg, _ := (toolChoice{Mode: "function", Name: "get_weather"}).violation(call); msg != "" {
+		t.Errorf("expected the named call to comply, got %q", msg)
+	}
+	if msg, retry := (toolChoice{Mode: "function", Name: "get_time"}).violation(call); msg == "" || retry {
+		t.Error("expected a call to the wrong tool to fail without retrying")
+	}
+}
+
+func TestAnthropicToolChoice(t *testing.T) {
+	tests := map[string]toolChoice{
+		"auto": {Mode: "auto"},
+		"any":  {Mode: "required"},
+		"none": {Mode: "none"},
+	}
+	for in, want := range tests {
+		if got := anthropicToolChoice(&AnthropicToolChoice{Type: in}); got != want {
+			t.Errorf("%s: got %+v, want %+v", in, got, want)
+		}
+	}
+	if got := anthropicToolChoice(&AnthropicToolChoice{Type: "tool", Name: "get_weather"}); got != (toolChoice{Mode: "function", Name: "get_weather"}) {
+		t.Errorf("tool: got %+v", got)
+	}
+}
+
+func TestTurnErrorStatusToolChoice(t *testing.T) {
+	status, msg := turnErrorStatus(&toolChoiceError{Message: "The model did not call a tool as required by tool_choice"})
+	if status != http.StatusBadGateway || !strings.Contains(msg, "tool_choice") {
+		t.Errorf("got %d %q", status, msg)
+	}
+}
+
+func TestHandleChatCompletions_InvalidToolChoice(t *testing.T) {
+	srv := &Server{clients: &clientPool{}, defaultClient: &copilot.Client{}}
+	tests := []string{
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tool_choice":"sometimes"}`,
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tool_choice":"required"}`,
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"get_weather"}}],"tool_choice":{"type":"function","function":{"name":"get_time"}}}`,
+	}
+	for _, body := range tests {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		rw := &responseRecorder{head: http.Header{}}
+		srv.HandleChatCompletions(rw, req)
+		if rw.status != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, rw.status)
+		}
+	}
+}
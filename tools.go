@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+// toolBridge connects the handlers of a session's client tools to the
+// requests that carry their results. When the model calls a tool the SDK
+// invokes the handler, which blocks until the client's follow-up request
+// delivers the matching tool message, so the result reaches the model
+// natively within the same session.
+type toolBridge struct {
+	mu      sync.Mutex
+	results map[string]chan copilot.ToolResult
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newToolBridge() *toolBridge {
+	return &toolBridge{
+		results: make(map[string]chan copilot.ToolResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// attach registers the bridge as the handler of every tool in cfg
+func (b *toolBridge) attach(cfg *copilot.SessionConfig) {
+	for i := range cfg.Tools {
+		cfg.Tools[i].Handler = b.handle
+	}
+}
+
+// slot returns the channel carrying the result of a tool call. Either
+// side may get there first, so the channel is buffered.
+func (b *toolBridge) slot(toolCallID string) chan copilot.ToolResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch, ok := b.results[toolCallID]
+	if !ok {
+		ch = make(chan copilot.ToolResult, 1)
+		b.results[toolCallID] = ch
+	}
+	return ch
+}
+
+// handle is the copilot.ToolHandler for client tools. It waits for the
+// client to deliver the result, or for the session to be destroyed.
+func (b *toolBridge) handle(invocation copilot.ToolInvocation) (copilot.ToolResult, error) {
+	slog.Debug("Tool waiting for the client's result", "tool", invocation.ToolName, "tool_call_id", invocation.ToolCallID)
+	select {
+	case result := <-b.slot(invocation.ToolCallID):
+		b.mu.Lock()
+		delete(b.results, invocation.ToolCallID)
+		b.mu.Unlock()
+		return result, nil
+	case <-b.done:
+		return copilot.ToolResult{
+			TextResultForLLM: "The tool call was abandoned before the client returned a result.",
+			ResultType:       "failure",
+			Error:            "session closed",
+		}, nil
+	}
+}
+
+// resolve delivers the client's tool messages to the handlers waiting on
+// the pending tool calls. A pending call without a matching message fails
+// rather than leaving the model waiting.
+func (b *toolBridge) resolve(pending []string, messages []Message) {
+	provided := make(map[string]string)
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			provided[msg.ToolCallID] = msg.Content
+		}
+	}
+	for _, id := range pending {
+		result := copilot.ToolResult{
+			TextResultForLLM: "The client did not return a result for this tool call.",
+			ResultType:       "failure",
+			Error:            "missing tool result",
+		}
+		if content, ok := provided[id]; ok {
+			result = copilot.ToolResult{TextResultForLLM: content, ResultType: "success"}
+		}
+		select {
+		case b.slot(id) <- result:
+		default:
+			// Already resolved
+		}
+	}
+}
+
+// close releases every waiting handler. It is safe to call more than once.
+func (b *toolBridge) close() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// toolCallIDs returns the IDs of a turn's tool calls
+func toolCallIDs(calls []ToolCall) []string {
+	ids := make([]string, 0, len(calls))
+	for _, call := range calls {
+		ids = append(ids, call.ID)
+	}
+	return ids
+}
+
+// toolResultIDs returns the tool call IDs answered by messages, or nil
+// unless every message is a tool result.
+func toolResultIDs(messages []Message) []string {
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role != "tool" || msg.ToolCallID == "" {
+			return nil
+		}
+		ids = append(ids, msg.ToolCallID)
+	}
+	return ids
+}
+
+// toolCallKey returns the cache key of a session parked on the given tool
+// calls. The IDs are chosen by the model and unique per call, so together
+// with the session's owner and configuration they identify the session
+// without hashing the rest of the conversation.
+func toolCallKey(req conversationRequest, ids []string) string {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode([]interface{}{req.Owner, req.Model, req.Stream})
+	enc.Encode(req.Tools)
+	enc.Encode(sorted)
+	return "tools:" + hex.EncodeToString(h.Sum(nil))
+}
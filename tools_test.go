@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+)
+
+func TestToolBridgeDeliversResults(t *testing.T) {
+	bridge := newToolBridge()
+
+	results := make(chan copilot.ToolResult, 2)
+	for _, id := range []string{"call_1", "call_2"} {
+		go func(id string) {
+			result, _ := bridge.handle(copilot.ToolInvocation{ToolCallID: id, ToolName: "get_weather"})
+			results <- result
+		}(id)
+	}
+
+	bridge.resolve([]string{"call_1", "call_2"}, []Message{
+		{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+	})
+
+	got := map[string]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-results:
+			got[result.ResultType]++
+			if result.ResultType == "success" && result.TextResultForLLM != "sunny" {
+				t.Errorf("unexpected result text %q", result.TextResultForLLM)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for tool handlers")
+		}
+	}
+	if got["success"] != 1 || got["failure"] != 1 {
+		t.Errorf("expected one delivered and one missing result, got %v", got)
+	}
+}
+
+func TestToolBridgeResultBeforeInvocation(t *testing.T) {
+	bridge := newToolBridge()
+	bridge.resolve([]string{"call_1"}, []Message{{Role: "tool", ToolCallID: "call_1", Content: "42"}})
+
+	result, err := bridge.handle(copilot.ToolInvocation{ToolCallID: "call_1"})
+	if err != nil || result.TextResultForLLM != "42" {
+		t.Errorf("expected the buffered result, got %+v, %v", result, err)
+	}
+}
+
+func TestToolBridgeCloseReleasesHandlers(t *testing.T) {
+	bridge := newToolBridge()
+	done := make(chan copilot.ToolResult)
+	go func() {
+		result, _ := bridge.handle(copilot.ToolInvocation{ToolCallID: "call_1"})
+		done <- result
+	}()
+
+	bridge.close()
+	bridge.close()
+	select {
+	case result := <-done:
+		if result.ResultType != "failure" {
+			t.Errorf("expected a failure result, got %q", result.ResultType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected close to release the handler")
+	}
+}
+
+func TestToolResultIDs(t *testing.T) {
+	ids := toolResultIDs([]Message{
+		{Role: "tool", ToolCallID: "call_1"},
+		{Role: "tool", ToolCallID: "call_2"},
+	})
+	if len(ids) != 2 {
+		t.Errorf("expected 2 IDs, got %v", ids)
+	}
+
+	if ids := toolResultIDs([]Message{
+		{Role: "tool", ToolCallID: "call_1"},
+		{Role: "user", Content: "and also"},
+	}); ids != nil {
+		t.Errorf("expected no IDs when the tail is not only tool results, got %v", ids)
+	}
+}
+
+func TestToolCallKey(t *testing.T) {
+	req := conversationRequest{Owner: "a", Model: "gpt-4"}
+	if toolCallKey(req, []string{"call_1", "call_2"}) != toolCallKey(req, []string{"call_2", "call_1"}) {
+		t.Error("expected the key to ignore order")
+	}
+
+	other := req
+	other.Owner = "b"
+	if toolCallKey(req, []string{"call_1"}) == toolCallKey(other, []string{"call_1"}) {
+		t.Error("expected the key to be scoped to its owner")
+	}
+
+	narrowed := req
+	narrowed.Tools = []Tool{{Type: "function", Function: ToolFunction{Name: "get_weather"}}}
+	if toolCallKey(req, []string{"call_1"}) == toolCallKey(narrowed, []string{"call_1"}) {
+		t.Error("expected a different tool set to get a different key")
+	}
+}
+
+func TestToolBridgeAttach(t *testing.T) {
+	bridge := newToolBridge()
+	cfg := sessionConfigFor("gpt-4", nil, []Tool{{Type: "function", Function: ToolFunction{Name: "get_weather"}}}, false)
+	bridge.attach(cfg)
+	if len(cfg.Tools) != 1 || cfg.Tools[0].Handler == nil {
+		t.Error("expected client tools to get a handler")
+	}
+}
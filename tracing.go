@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer returns the tracer for the server's spans from the global
+// provider. It is looked up on every use, since a tracer obtained before
+// setupTracing stays bound to the first provider installed. Until then it
+// is a no-op.
+func tracer() trace.Tracer {
+	return otel.Tracer("copilot-openai-server")
+}
+
+// genAIProvider is the gen_ai.provider.name of Copilot spans
+var genAIProvider = semconv.GenAIProviderNameKey.String("github_copilot")
+
+// setupTracing installs the global tracer provider for exporter, which is
+// "otlp" (OTLP over HTTP, configured with the standard OTEL_EXPORTER_OTLP_*
+// variables), "stdout" or "none". W3C trace context is propagated either
+// way. The returned function flushes and stops the exporter.
+func setupTracing(exporter string, stdout io.Writer) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q; use otlp, stdout or none", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("copilot-openai-server"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// defaultTraceExporter picks the exporter from OTEL_TRACES_EXPORTER
+func defaultTraceExporter() string {
+	if exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter != "" {
+		return exporter
+	}
+	return "none"
+}
+
+// TraceRequests starts a server span for the API requests served by next,
+// continuing the trace of the caller's traceparent header if it sent one.
+func TraceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if metricsEndpoint(r.URL.Path) == "other" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := metricsEndpoint(r.URL.Path)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+
+		wrapped := newResponseWriter(w, false)
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(wrapped.statusCode))
+		if wrapped.statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(wrapped.statusCode))
+		}
+	})
+}
+
+// decodeRequest decodes a JSON request body inside a span
+func decodeRequest(r *http.Request, v interface{}) error {
+	_, span := tracer().Start(r.Context(), "parse_request")
+	defer span.End()
+	return endSpan(span, json.NewDecoder(r.Body).Decode(v))
+}
+
+// endSpan records err, if any, on span and returns it
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// startTurnSpan starts the GenAI client span of one turn on a session
+func startTurnSpan(ctx context.Context, operation, model, sessionID string, opts turnOptions) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.GenAIOperationNameKey.String(operation),
+		genAIProvider,
+		semconv.GenAIRequestModel(model),
+	}
+	if sessionID != "" {
+		attrs = append(attrs, semconv.GenAIConversationID(sessionID))
+	}
+	if opts.MaxTokens > 0 {
+		attrs = append(attrs, semconv.GenAIRequestMaxTokens(opts.MaxTokens))
+	}
+	if len(opts.Stop) > 0 {
+		attrs = append(attrs, semconv.GenAIRequestStopSequences(opts.Stop...))
+	}
+	return tracer().Start(ctx, operation+" "+model, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endTurnSpan records the outcome of a turn on its span and ends it
+func endTurnSpan(span trace.Span, result *turnResult, err error) {
+	defer span.End()
+	if endSpan(span, err) != nil || result == nil {
+		return
+	}
+	span.SetAttributes(semconv.GenAIResponseFinishReasons(result.FinishReason))
+	if result.Usage != nil {
+		span.SetAttributes(
+			semconv.GenAIUsageInputTokens(result.Usage.PromptTokens),
+			semconv.GenAIUsageOutputTokens(result.Usage.CompletionTokens),
+		)
+	}
+}
+
+// addTurnEvent adds an event, such as the first delta or a tool call, to
+// the turn span in ctx
+func addTurnEvent(ctx context.Context, name string, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).AddEvent(name, trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestTraceRequests(t *testing.T) {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	var out bytes.Buffer
+	shutdown, err := setupTracing("stdout", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := TraceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		if err := decodeRequest(r, &req); err != nil {
+			t.Fatal(err)
+		}
+		ctx, span := startTurnSpan(r.Context(), "chat", req.Model, "session-1", turnOptions{MaxTokens: 5})
+		addTurnEvent(ctx, "gen_ai.first_delta")
+		endTurnSpan(span, &turnResult{Content: "hello", FinishReason: "stop", Usage: &Usage{PromptTokens: 8, CompletionTokens: 1}}, nil)
+	}))
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(&responseRecorder{head: http.Header{}}, req)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := out.String()
+	for _, want := range []string{
+		`"Name":"POST /v1/chat/completions"`,
+		`"Name":"parse_request"`,
+		`"Name":"chat gpt-4o"`,
+		`"Name":"gen_ai.first_delta"`,
+		`"gen_ai.request.model"`,
+		`"gen_ai.usage.output_tokens"`,
+	} {
+		if !strings.Contains(spans, want) {
+			t.Errorf("expected exported spans to contain %s", want)
+		}
+	}
+	if strings.Count(spans, `"TraceID":"4bf92f3577b34da6a3ce929d0e0e4736"`) < 3 {
+		t.Errorf("expected every span to continue the incoming trace, got %s", spans)
+	}
+}
+
+func TestSetupTracingUnknownExporter(t *testing.T) {
+	if _, err := setupTracing("zipkin", nil); err == nil {
+		t.Error("expected an unknown exporter to be rejected")
+	}
+}
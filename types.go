@@ -1,37 +1,77 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // OpenAI API Request/Response Types
 
 // ChatCompletionRequest represents an OpenAI chat completion request
 type ChatCompletionRequest struct {
-	Model            string      `json:"model"`
-	Messages         []Message   `json:"messages"`
-	Temperature      *float64    `json:"temperature,omitempty"`
-	TopP             *float64    `json:"top_p,omitempty"`
-	N                *int        `json:"n,omitempty"`
-	Stream           bool        `json:"stream"`
-	Stop             interface{} `json:"stop,omitempty"`
-	MaxTokens        *int        `json:"max_tokens,omitempty"`
-	PresencePenalty  *float64    `json:"presence_penalty,omitempty"`
-	FrequencyPenalty *float64    `json:"frequency_penalty,omitempty"`
-	Tools            []Tool      `json:"tools,omitempty"`
-	ToolChoice       interface{} `json:"tool_choice,omitempty"`
-	User             string      `json:"user,omitempty"`
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	TopP          *float64       `json:"top_p,omitempty"`
+	N             *int           `json:"n,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Stop          interface{}    `json:"stop,omitempty"`
+	MaxTokens     *int           `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens supersedes MaxTokens
+	MaxCompletionTokens *int        `json:"max_completion_tokens,omitempty"`
+	PresencePenalty     *float64    `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64    `json:"frequency_penalty,omitempty"`
+	Tools               []Tool      `json:"tools,omitempty"`
+	ToolChoice          interface{} `json:"tool_choice,omitempty"`
+	User                string      `json:"user,omitempty"`
+	// ResponseFormat constrains the output to JSON, optionally
+	// matching a schema.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
 	// ApiKey is the GitHub Copilot token supplied by the client.
 	// It mirrors the OpenAI `api_key` convention and may also be
 	// provided via the Authorization header.
-	ApiKey           string      `json:"api_key,omitempty"`
+	ApiKey string `json:"api_key,omitempty"`
+}
+
+// ResponseFormat represents an OpenAI response_format: "text",
+// "json_object" or "json_schema"
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat describes the schema of a json_schema response_format
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
 }
 
 // Message represents a chat message
 type Message struct {
-	Role       string     `json:"role,omitempty"`
-	Content    string     `json:"content,omitempty"`
-	Name       string     `json:"name,omitempty"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+	// Parts holds the original content parts when the client sent
+	// content in array form; Content then carries their flattened text.
+	Parts      []ContentPart `json:"-"`
+	Name       string        `json:"name,omitempty"`
+	ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID string        `json:"tool_call_id,omitempty"`
+}
+
+// ContentPart represents one element of an array-form message content
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL represents the image reference of an image_url content part
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
 }
 
 // Tool represents a tool definition
@@ -80,6 +120,12 @@ type Choice struct {
 	FinishReason *string  `json:"finish_reason"`
 }
 
+// StreamOptions controls what is sent when streaming
+type StreamOptions struct {
+	// IncludeUsage adds a final chunk with the usage of the request
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
+
 // Usage represents token usage information
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
@@ -95,6 +141,9 @@ type ChatCompletionChunk struct {
 	Model             string   `json:"model"`
 	Choices           []Choice `json:"choices"`
 	SystemFingerprint string   `json:"system_fingerprint,omitempty"`
+	// Usage is only set on the final chunk when requested with
+	// stream_options.include_usage
+	Usage *Usage `json:"usage,omitempty"`
 }
 
 // ModelsResponse represents the response for /v1/models
@@ -124,6 +173,398 @@ type ErrorDetail struct {
 	Code    *string `json:"code,omitempty"`
 }
 
+// CompletionRequest represents a legacy OpenAI completion request. Prompt
+// may be a string or an array of strings.
+type CompletionRequest struct {
+	Model       string      `json:"model"`
+	Prompt      interface{} `json:"prompt"`
+	Suffix      string      `json:"suffix,omitempty"`
+	MaxTokens   *int        `json:"max_tokens,omitempty"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	TopP        *float64    `json:"top_p,omitempty"`
+	N           *int        `json:"n,omitempty"`
+	Stream      bool        `json:"stream"`
+	Echo        bool        `json:"echo,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"`
+	User        string      `json:"user,omitempty"`
+	// ApiKey mirrors ChatCompletionRequest.ApiKey.
+	ApiKey string `json:"api_key,omitempty"`
+}
+
+// CompletionResponse represents a legacy completion response or, with
+// Object "text_completion" and partial text, a streaming chunk
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// CompletionChoice represents a legacy completion choice
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// OpenAI Responses API Types
+
+// ResponsesRequest represents an OpenAI Responses API request
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              ResponseInput     `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	Tools              []ResponseTool    `json:"tools,omitempty"`
+	ToolChoice         interface{}       `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	Stream             bool              `json:"stream"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Temperature        *float64          `json:"temperature,omitempty"`
+	TopP               *float64          `json:"top_p,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	User               string            `json:"user,omitempty"`
+	// ApiKey mirrors ChatCompletionRequest.ApiKey.
+	ApiKey string `json:"api_key,omitempty"`
+}
+
+// ResponseInput holds the input items of a Responses request. A plain
+// string input is decoded as a single user message.
+type ResponseInput []ResponseInputItem
+
+// ResponseInputItem represents one input item: a message, a function
+// call made by the assistant, or the output of such a call
+type ResponseInputItem struct {
+	Type      string          `json:"type,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Role      string          `json:"role,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    string          `json:"output,omitempty"`
+}
+
+// ResponseInputContent represents a content part of an input message
+type ResponseInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+// ResponseTool represents a tool definition in the Responses API, where
+// function fields are flattened into the tool itself
+type ResponseTool struct {
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Strict      *bool                  `json:"strict,omitempty"`
+}
+
+// ResponseObject represents a response returned by the Responses API
+type ResponseObject struct {
+	ID                 string                     `json:"id"`
+	Object             string                     `json:"object"`
+	CreatedAt          int64                      `json:"created_at"`
+	Status             string                     `json:"status"`
+	Model              string                     `json:"model"`
+	Output             []ResponseOutputItem       `json:"output"`
+	Instructions       string                     `json:"instructions,omitempty"`
+	PreviousResponseID string                     `json:"previous_response_id,omitempty"`
+	Tools              []ResponseTool             `json:"tools"`
+	ToolChoice         interface{}                `json:"tool_choice"`
+	ParallelToolCalls  bool                       `json:"parallel_tool_calls"`
+	Usage              *ResponseUsage             `json:"usage,omitempty"`
+	Error              *ResponseError             `json:"error"`
+	IncompleteDetails  *ResponseIncompleteDetails `json:"incomplete_details"`
+	Metadata           map[string]string          `json:"metadata,omitempty"`
+}
+
+// ResponseOutputItem represents an output item: an assistant message or
+// a function call
+type ResponseOutputItem struct {
+	Type      string                  `json:"type"`
+	ID        string                  `json:"id"`
+	Status    string                  `json:"status,omitempty"`
+	Role      string                  `json:"role,omitempty"`
+	Content   []ResponseOutputContent `json:"content,omitempty"`
+	CallID    string                  `json:"call_id,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+	Arguments string                  `json:"arguments,omitempty"`
+}
+
+// ResponseOutputContent represents a content part of an output message
+type ResponseOutputContent struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// ResponseUsage represents token usage of a response
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponseIncompleteDetails explains why a response is incomplete
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// ResponseError describes why a response failed
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ResponseStreamEvent represents a typed `response.*` SSE event. Only the
+// fields relevant to the event type are set.
+type ResponseStreamEvent struct {
+	Type           string                 `json:"type"`
+	SequenceNumber int                    `json:"sequence_number"`
+	Response       *ResponseObject        `json:"response,omitempty"`
+	OutputIndex    *int                   `json:"output_index,omitempty"`
+	ContentIndex   *int                   `json:"content_index,omitempty"`
+	ItemID         string                 `json:"item_id,omitempty"`
+	Item           *ResponseOutputItem    `json:"item,omitempty"`
+	Part           *ResponseOutputContent `json:"part,omitempty"`
+	Delta          *string                `json:"delta,omitempty"`
+	Text           *string                `json:"text,omitempty"`
+	Arguments      *string                `json:"arguments,omitempty"`
+	Code           string                 `json:"code,omitempty"`
+	Message        string                 `json:"message,omitempty"`
+}
+
+// Anthropic Messages API Types
+
+// AnthropicRequest represents an Anthropic Messages API request
+type AnthropicRequest struct {
+	Model         string                 `json:"model"`
+	Messages      []AnthropicMessage     `json:"messages"`
+	System        AnthropicContent       `json:"system,omitempty"`
+	MaxTokens     int                    `json:"max_tokens"`
+	StopSequences []string               `json:"stop_sequences,omitempty"`
+	Stream        bool                   `json:"stream"`
+	Temperature   *float64               `json:"temperature,omitempty"`
+	TopP          *float64               `json:"top_p,omitempty"`
+	TopK          *int                   `json:"top_k,omitempty"`
+	Tools         []AnthropicTool        `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice   `json:"tool_choice,omitempty"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// AnthropicMessage represents a message in an Anthropic request
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent holds content blocks. A plain string is decoded as a
+// single text block.
+type AnthropicContent []AnthropicContentBlock
+
+// AnthropicContentBlock represents a request content block: text, image,
+// tool_use or tool_result
+type AnthropicContentBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *AnthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   AnthropicContent      `json:"content,omitempty"`
+	IsError   bool                  `json:"is_error,omitempty"`
+}
+
+// AnthropicImageSource represents the source of an image block
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicTool represents an Anthropic tool definition
+type AnthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// AnthropicToolChoice represents an Anthropic tool_choice
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicResponse represents an Anthropic Messages API response
+type AnthropicResponse struct {
+	ID           string                   `json:"id"`
+	Type         string                   `json:"type"`
+	Role         string                   `json:"role"`
+	Model        string                   `json:"model"`
+	Content      []AnthropicResponseBlock `json:"content"`
+	StopReason   *string                  `json:"stop_reason"`
+	StopSequence *string                  `json:"stop_sequence"`
+	Usage        AnthropicUsage           `json:"usage"`
+}
+
+// AnthropicResponseBlock represents a text or tool_use block of a response
+type AnthropicResponseBlock struct {
+	Type  string          `json:"type"`
+	Text  *string         `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// AnthropicUsage represents token usage of an Anthropic response
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicStreamEvent represents an Anthropic SSE event. Delta holds an
+// AnthropicContentDelta or an AnthropicMessageDelta depending on Type.
+type AnthropicStreamEvent struct {
+	Type         string                  `json:"type"`
+	Message      *AnthropicResponse      `json:"message,omitempty"`
+	Index        *int                    `json:"index,omitempty"`
+	ContentBlock *AnthropicResponseBlock `json:"content_block,omitempty"`
+	Delta        interface{}             `json:"delta,omitempty"`
+	Usage        *AnthropicUsage         `json:"usage,omitempty"`
+	Error        *AnthropicErrorDetail   `json:"error,omitempty"`
+}
+
+// AnthropicContentDelta represents a content_block_delta payload
+type AnthropicContentDelta struct {
+	Type        string  `json:"type"`
+	Text        *string `json:"text,omitempty"`
+	PartialJSON *string `json:"partial_json,omitempty"`
+}
+
+// AnthropicMessageDelta represents a message_delta payload
+type AnthropicMessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+// AnthropicErrorResponse represents an Anthropic API error
+type AnthropicErrorResponse struct {
+	Type  string               `json:"type"`
+	Error AnthropicErrorDetail `json:"error"`
+}
+
+// AnthropicErrorDetail contains Anthropic error details
+type AnthropicErrorDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// Ollama API Types
+
+// OllamaChatRequest represents an Ollama /api/chat request
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []Tool          `json:"tools,omitempty"`
+	Stream   *bool           `json:"stream,omitempty"`
+	Options  *OllamaOptions  `json:"options,omitempty"`
+}
+
+// OllamaGenerateRequest represents an Ollama /api/generate request
+type OllamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	System  string         `json:"system,omitempty"`
+	Images  []string       `json:"images,omitempty"`
+	Stream  *bool          `json:"stream,omitempty"`
+	Options *OllamaOptions `json:"options,omitempty"`
+}
+
+// OllamaOptions holds the model options of an Ollama request that the
+// server understands
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+}
+
+// OllamaMessage represents an Ollama chat message. Images are raw base64
+// strings without a data: prefix.
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+// OllamaToolCall represents a tool call in an Ollama message. Unlike
+// OpenAI, arguments are a JSON object and calls carry no ID.
+type OllamaToolCall struct {
+	Function OllamaToolCallFunction `json:"function"`
+}
+
+// OllamaToolCallFunction represents the function details of an Ollama
+// tool call
+type OllamaToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// OllamaResponse represents an /api/chat or /api/generate response or
+// streamed line. Chat responses set Message, generate responses set
+// Response.
+type OllamaResponse struct {
+	Model         string         `json:"model"`
+	CreatedAt     string         `json:"created_at"`
+	Message       *OllamaMessage `json:"message,omitempty"`
+	Response      *string        `json:"response,omitempty"`
+	Done          bool           `json:"done"`
+	DoneReason    string         `json:"done_reason,omitempty"`
+	TotalDuration int64          `json:"total_duration,omitempty"`
+	LoadDuration  int64          `json:"load_duration,omitempty"`
+	EvalCount     int            `json:"eval_count,omitempty"`
+	EvalDuration  int64          `json:"eval_duration,omitempty"`
+}
+
+// OllamaTagsResponse represents the response for /api/tags
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+// OllamaModel represents a single model in the /api/tags list
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+// OllamaModelDetails represents the details of an Ollama model
+type OllamaModelDetails struct {
+	Format            string `json:"format"`
+	Family            string `json:"family"`
+	ParameterSize     string `json:"parameter_size"`
+	QuantizationLevel string `json:"quantization_level"`
+}
+
+// OllamaErrorResponse represents an Ollama API error
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
+
 // Helper function to get current timestamp
 func currentTimestamp() int64 {
 	return time.Now().Unix()
@@ -133,3 +574,8 @@ func currentTimestamp() int64 {
 func strPtr(s string) *string {
 	return &s
 }
+
+// Helper to create an int pointer
+func intPtr(i int) *int {
+	return &i
+}